@@ -1,18 +1,33 @@
 package speedycloud
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"time"
 
 	"github.com/docker/machine/libmachine/log"
-	"github.com/docker/machine/libmachine/mcnutils"
 	"github.com/hna/speedycloud"
-    "github.com/hna/speedycloud/computing/v2/keypairs"
-	"github.com/hna/speedycloud/computing/v2/startstop"
-	//"github.com/hna/speedycloud/computing/v2/images"
+	"github.com/hna/speedycloud/computing/v2/images"
+	"github.com/hna/speedycloud/computing/v2/jobs"
+	"github.com/hna/speedycloud/computing/v2/keypairs"
+	"github.com/hna/speedycloud/computing/v2/quotas"
+	"github.com/hna/speedycloud/computing/v2/securitygroups"
 	"github.com/hna/speedycloud/computing/v2/servers"
-    //"github.com/hna/speedycloud/networking/v2/networks"
-    //"github.com/hna/speedycloud/pagination"
+	"github.com/hna/speedycloud/computing/v2/snapshots"
+	"github.com/hna/speedycloud/computing/v2/startstop"
+	"github.com/hna/speedycloud/computing/v2/volumes"
+	"github.com/hna/speedycloud/computing/v2/zones"
+	"github.com/hna/speedycloud/identity/v1/tokens"
+	"github.com/hna/speedycloud/networking/v2/floatingips"
+	"github.com/hna/speedycloud/networking/v2/networks"
+	"golang.org/x/net/context"
+	//"github.com/hna/speedycloud/pagination"
 )
 
 type Client interface {
@@ -21,24 +36,45 @@ type Client interface {
 	InitProviderClient(d *Driver) error
 	InitNetworkClient(d *Driver) error
 	CreateInstance(d *Driver) (string, error)
-	GetInstanceState(d *Driver) (string, error)
-	StartInstance(d *Driver) error
-	StopInstance(d *Driver) error
-	RestartInstance(d *Driver) error
-	DeleteInstance(d *Driver) error
-	WaitForInstanceStatus(d *Driver, status string) error
-	GetInstanceIPAddresses(d *Driver) ([]string, error)
+	GetInstanceState(d *Driver) (string, bool, error)
+	StartInstance(d *Driver) (string, error)
+	StopInstance(d *Driver) (string, error)
+	RestartInstance(d *Driver) (string, error)
+	PowerOffInstance(d *Driver) (string, error)
+	ResizeInstance(d *Driver, cpu, memory, bandwidth, disk int) (string, error)
+	DeleteInstance(d *Driver) (string, error)
+	WaitForJob(d *Driver, jobID string, timeout int) error
+	WaitForInstanceStatus(d *Driver, status string, timeout int) error
+	GetInstanceIPAddresses(d *Driver) ([]IPAddress, error)
 	GetPublicKey(keyPairName string) ([]byte, error)
 	CreateKeyPair(d *Driver, name string, publicKey string) error
 	DeleteKeyPair(d *Driver, name string) error
     GetKeyPairID(d *Driver, name string) (string, error)
+	GetKeyPair(d *Driver, name string) (*keypairs.KeyPair, error)
     UpdateInstanceGroup(d *Driver) error
     UpdateInstanceAlias(d *Driver) error
-	//GetNetworkID(d *Driver) (string, error)
+	GetNetworkID(d *Driver) (string, error)
 	//GetFlavorID(d *Driver) (string, error)
-	//GetImageID(d *Driver) (string, error)
-	//AssignFloatingIP(d *Driver, floatingIP *FloatingIP) error
-	//GetFloatingIPs(d *Driver) ([]FloatingIP, error)
+	GetImageNames(d *Driver) ([]string, error)
+	GetAvailabilityZones(d *Driver) ([]string, error)
+	GetQuota(d *Driver) (*quotas.Quota, error)
+	GetSecurityGroup(d *Driver, name string) (*securitygroups.SecurityGroup, error)
+	CreateSecurityGroup(d *Driver, name string) (*securitygroups.SecurityGroup, error)
+	DeleteSecurityGroup(d *Driver, id string) error
+	AddSecurityGroupRule(d *Driver, groupID string, port int) error
+	CreateVolume(d *Driver, name string, volumeType string, size int) (string, error)
+	AttachVolume(d *Driver, volumeID string) error
+	DetachVolume(d *Driver, volumeID string) error
+	DeleteVolume(d *Driver, volumeID string) error
+	WaitForVolumeStatus(d *Driver, volumeID string, status string) error
+	GetSnapshots(d *Driver) ([]snapshots.Snapshot, error)
+	CreateSnapshot(d *Driver, name string) (string, error)
+	RestoreSnapshot(d *Driver, snapshotID string) error
+	WaitForSnapshotStatus(d *Driver, snapshotID string, status string) error
+	AssignFloatingIP(d *Driver, floatingIP *FloatingIP) error
+	GetFloatingIPs(d *Driver) ([]FloatingIP, error)
+	DisassociateFloatingIP(d *Driver, id string) error
+	ReleaseFloatingIP(d *Driver, id string) error
 	//GetFloatingIPPoolID(d *Driver) (string, error)
 	//GetInstancePortID(d *Driver) (string, error)
 	//GetTenantID(d *Driver) (string, error)
@@ -60,6 +96,7 @@ func (c *GenericClient) CreateInstance(d *Driver) (string, error) {
 
 	serverOpts := servers.CreateOpts{
 		ImageName:        d.ImageType,
+		SnapshotID:       d.SnapshotId,
 		Network:          d.NetworkName,
 		CpuNumber:        d.CpuNumber,
 		Memory:           d.Memory,
@@ -70,6 +107,7 @@ func (c *GenericClient) CreateInstance(d *Driver) (string, error) {
         SshKey:           keyPairID,
 		Name:             d.MachineName,
 		AvailabilityZone: d.AvailabilityZone,
+		SecurityGroups:   d.securityGroupNames(),
 	}
 	if d.UserData != ""{
         serverOpts.BootScript = d.UserData
@@ -97,49 +135,65 @@ type IPAddress struct {
 	Mac         string
 }
 
-//type FloatingIP struct {
-//	Id        string
-//	Ip        string
-//	NetworkId string
-//	PortId    string
-//	Pool      string
-//	MachineId string
-//}
+type FloatingIP struct {
+	Id        string
+	Ip        string
+	Pool      string
+	MachineId string
+}
 
-func (c *GenericClient) GetInstanceState(d *Driver) (string, error) {
+// GetInstanceState returns the status of the instance and whether a job is
+// running on it.
+func (c *GenericClient) GetInstanceState(d *Driver) (string, bool, error) {
 	server, err := c.GetServerDetail(d)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
-	return server.Status, nil
+	return server.Status, server.HasRunningJob, nil
 }
 
-func (c *GenericClient) StartInstance(d *Driver) error {
-	if result := startstop.Start(c.Compute, d.MachineId); result.Err != nil {
-		return result.Err
-	}
-	return nil
+// StartInstance, StopInstance, RestartInstance, PowerOffInstance,
+// ResizeInstance and DeleteInstance return the ID of the job carrying out the operation, empty
+// when the API did not report one.
+func (c *GenericClient) StartInstance(d *Driver) (string, error) {
+	return startstop.Start(c.Compute, d.MachineId).ExtractJobID()
 }
 
-func (c *GenericClient) StopInstance(d *Driver) error {
-	if result := startstop.Stop(c.Compute, d.MachineId); result.Err != nil {
-		return result.Err
-	}
-	return nil
+func (c *GenericClient) StopInstance(d *Driver) (string, error) {
+	return startstop.Stop(c.Compute, d.MachineId).ExtractJobID()
 }
 
-func (c *GenericClient) RestartInstance(d *Driver) error {
-	if result := servers.Reboot(c.Compute, d.MachineId); result.Err != nil {
-		return result.Err
+// RestartInstance reboots the instance with the restart method of the driver.
+func (c *GenericClient) RestartInstance(d *Driver) (string, error) {
+	how := servers.SoftReboot
+	if d.RestartMethod == "hard" {
+		how = servers.HardReboot
 	}
-	return nil
+	return servers.Reboot(c.Compute, d.MachineId, how).ExtractJobID()
 }
 
-func (c *GenericClient) DeleteInstance(d *Driver) error {
-	if result := servers.Delete(c.Compute, d.MachineId); result.Err != nil {
-		return result.Err
+func (c *GenericClient) PowerOffInstance(d *Driver) (string, error) {
+	return startstop.PowerOff(c.Compute, d.MachineId).ExtractJobID()
+}
+
+func (c *GenericClient) ResizeInstance(d *Driver, cpu, memory, bandwidth, disk int) (string, error) {
+	opts := servers.ResizeOpts{
+		CpuNumber:    cpu,
+		Memory:       memory,
+		Bandwidth:    bandwidth,
+		DiskCapacity: disk,
 	}
-	return nil
+	return servers.Resize(c.Compute, d.MachineId, opts).ExtractJobID()
+}
+
+func (c *GenericClient) DeleteInstance(d *Driver) (string, error) {
+	return servers.Delete(c.Compute, d.MachineId).ExtractJobID()
+}
+
+// WaitForJob blocks until the job completes, for at most timeout seconds. A
+// failed job is reported with the reason given by the API.
+func (c *GenericClient) WaitForJob(d *Driver, jobID string, timeout int) error {
+	return jobs.PollCompletion(context.Background(), c.Compute, jobID, d.newPoller(timeout))
 }
 
 func (c *GenericClient) UpdateInstanceGroup(d *Driver) error {
@@ -160,38 +214,73 @@ func (c *GenericClient) UpdateInstanceAlias(d *Driver) error {
     return nil
 }
 
-func (c *GenericClient) WaitForInstanceStatus(d *Driver, status string) error {
+// WaitForInstanceStatus blocks until the instance reaches status, for at most
+// timeout seconds. An instance in the error status fails the wait at once.
+func (c *GenericClient) WaitForInstanceStatus(d *Driver, status string, timeout int) error {
+	return servers.PollStatus(context.Background(), c.Compute, d.MachineId, status, d.newPoller(timeout))
+}
 
-	return mcnutils.WaitForSpecificOrError(func() (bool, error) {
-		current, err := servers.Get(c.Compute, d.MachineId).Extract()
+// GetInstanceIPAddresses returns the addresses of the instance. Addresses that
+// belong to one of the networks the instance joined are tagged with its name.
+func (c *GenericClient) GetInstanceIPAddresses(d *Driver) ([]IPAddress, error) {
+	server, err := c.GetServerDetail(d)
+	if err != nil {
+		return nil, err
+	}
+
+	joined := []*networks.Network{}
+	if len(server.JoinedNetworks) > 0 && c.Network != nil {
+		networkList, err := networks.List(c.Network, networks.ListOpts{AvailabilityZone: d.AvailabilityZone}).Extract()
 		if err != nil {
-			return true, err
+			return nil, err
 		}
-
-		if current.Status == "ERROR" {
-			return true, fmt.Errorf("Instance creation failed. Instance is in ERROR state")
+		for i, n := range networkList {
+			if containsString(server.JoinedNetworks, n.Name) {
+				joined = append(joined, &networkList[i])
+			}
 		}
+	}
 
-		if current.Status == status {
-			return true, nil
+	addresses := []IPAddress{}
+	for _, a := range server.Ips {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			log.Debugf("Ignoring malformed address %q of instance %s", a, d.MachineId)
+			continue
 		}
-
-		return false, nil
-	}, (d.ActiveTimeout / 4), 4*time.Second)
+		address := IPAddress{
+			AddressType: Fixed,
+			Address:     a,
+			Version:     4,
+		}
+		if ip.To4() == nil {
+			address.Version = 6
+		}
+		for _, n := range joined {
+			if _, cidr, err := net.ParseCIDR(n.Cidr); err == nil && cidr.Contains(ip) {
+				address.Network = n.Name
+				break
+			}
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
 }
 
-func (c *GenericClient) GetInstanceIPAddresses(d *Driver) ([]string, error) {
-	server, err := c.GetServerDetail(d)
+func (c *GenericClient) GetNetworkID(d *Driver) (string, error) {
+	opts := networks.ListOpts{AvailabilityZone: d.AvailabilityZone}
+	networkList, err := networks.List(c.Network, opts).Extract()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-    addresses := server.Ips
-	return addresses, nil
-}
 
-//func (c *GenericClient) GetNetworkID(d *Driver) (string, error) {
-//	return c.getNetworkID(d, d.NetworkName)
-//}
+	for _, n := range networkList {
+		if n.Name == d.NetworkName || n.DisplayName == d.NetworkName {
+			return n.ID, nil
+		}
+	}
+	return "", nil
+}
 
 //func (c *GenericClient) GetFloatingIPPoolID(d *Driver) (string, error) {
 //	return c.getNetworkID(d, d.FloatingIpPool)
@@ -244,31 +333,144 @@ func (c *GenericClient) GetInstanceIPAddresses(d *Driver) ([]string, error) {
 //	return flavorID, err
 //}
 
-//func (c *GenericClient) GetImageID(d *Driver) (string, error) {
-//	opts := images.ListOpts{Name: d.ImageType}
-//	pager := images.ListDetail(c.Compute, opts)
-//	imageID := ""
-//
-//	err := pager.EachPage(func(page pagination.Page) (bool, error) {
-//		imageList, err := images.ExtractImages(page)
-//		if err != nil {
-//			return false, err
-//		}
-//
-//		for _, i := range imageList {
-//			if i.Name == d.ImageType {
-//				imageID = i.ID
-//				return false, nil
-//			}
-//		}
-//
-//		return true, nil
-//	})
-//
-//	return imageID, err
-//}
+func (c *GenericClient) GetImageNames(d *Driver) ([]string, error) {
+	opts := images.ListOpts{AvailabilityZone: d.AvailabilityZone}
+	imageList, err := images.List(c.Compute, opts).Extract()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(imageList))
+	for _, i := range imageList {
+		names = append(names, i.Name)
+	}
+	return names, nil
+}
+
+func (c *GenericClient) GetAvailabilityZones(d *Driver) ([]string, error) {
+	zoneList, err := zones.List(c.Compute).Extract()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(zoneList))
+	for _, z := range zoneList {
+		names = append(names, z.Name)
+	}
+	return names, nil
+}
+
+func (c *GenericClient) GetQuota(d *Driver) (*quotas.Quota, error) {
+	return quotas.Get(c.Compute, d.AvailabilityZone).Extract()
+}
+
+func (c *GenericClient) GetSecurityGroup(d *Driver, name string) (*securitygroups.SecurityGroup, error) {
+	groups, err := securitygroups.List(c.Compute).Extract()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, g := range groups {
+		if g.Name == name {
+			return &g, nil
+		}
+	}
+	return nil, nil
+}
 
+func (c *GenericClient) CreateSecurityGroup(d *Driver, name string) (*securitygroups.SecurityGroup, error) {
+	opts := securitygroups.CreateOpts{
+		Name:        name,
+		Description: "Docker Machine",
+	}
+	return securitygroups.Create(c.Compute, opts).Extract()
+}
 
+func (c *GenericClient) DeleteSecurityGroup(d *Driver, id string) error {
+	if result := securitygroups.Delete(c.Compute, id); result.Err != nil {
+		return result.Err
+	}
+	return nil
+}
+
+func (c *GenericClient) AddSecurityGroupRule(d *Driver, groupID string, port int) error {
+	opts := securitygroups.RuleOpts{
+		Protocol:     "tcp",
+		PortRangeMin: port,
+		PortRangeMax: port,
+	}
+	if result := securitygroups.AddRule(c.Compute, groupID, opts); result.Err != nil {
+		return result.Err
+	}
+	return nil
+}
+
+func (c *GenericClient) CreateVolume(d *Driver, name string, volumeType string, size int) (string, error) {
+	opts := volumes.CreateOpts{
+		AvailabilityZone: d.AvailabilityZone,
+		Name:             name,
+		Type:             volumeType,
+		Size:             size,
+	}
+	volume, err := volumes.Create(c.Compute, opts).Extract()
+	if err != nil {
+		return "", err
+	}
+	return volume.ID, nil
+}
+
+func (c *GenericClient) AttachVolume(d *Driver, volumeID string) error {
+	if result := volumes.Attach(c.Compute, volumeID, d.MachineId); result.Err != nil {
+		return result.Err
+	}
+	return nil
+}
+
+func (c *GenericClient) DetachVolume(d *Driver, volumeID string) error {
+	if result := volumes.Detach(c.Compute, volumeID); result.Err != nil {
+		return result.Err
+	}
+	return nil
+}
+
+func (c *GenericClient) DeleteVolume(d *Driver, volumeID string) error {
+	if result := volumes.Delete(c.Compute, volumeID); result.Err != nil {
+		return result.Err
+	}
+	return nil
+}
+
+func (c *GenericClient) WaitForVolumeStatus(d *Driver, volumeID string, status string) error {
+	return volumes.PollStatus(context.Background(), c.Compute, volumeID, status, d.newPoller(d.ActiveTimeout))
+}
+
+func (c *GenericClient) GetSnapshots(d *Driver) ([]snapshots.Snapshot, error) {
+	opts := snapshots.ListOpts{AvailabilityZone: d.AvailabilityZone}
+	return snapshots.List(c.Compute, opts).Extract()
+}
+
+func (c *GenericClient) CreateSnapshot(d *Driver, name string) (string, error) {
+	opts := snapshots.CreateOpts{
+		ServerID: d.MachineId,
+		Name:     name,
+	}
+	snapshot, err := snapshots.Create(c.Compute, opts).Extract()
+	if err != nil {
+		return "", err
+	}
+	return snapshot.ID, nil
+}
+
+func (c *GenericClient) RestoreSnapshot(d *Driver, snapshotID string) error {
+	if result := snapshots.Restore(c.Compute, snapshotID); result.Err != nil {
+		return result.Err
+	}
+	return nil
+}
+
+func (c *GenericClient) WaitForSnapshotStatus(d *Driver, snapshotID string, status string) error {
+	return snapshots.PollStatus(context.Background(), c.Compute, snapshotID, status, d.newPoller(d.ActiveTimeout))
+}
 
 func (c *GenericClient) GetPublicKey(keyPairName string) ([]byte, error) {
 	kp, err := keypairs.GetAll(c.Compute).ExtractByDisplayName(keyPairName)
@@ -297,6 +499,21 @@ func (c *GenericClient) GetKeyPairID(d *Driver, name string) (string, error){
     return kp.ID, nil
 }
 
+// GetKeyPair returns the keypair named name, or nil if there is none.
+func (c *GenericClient) GetKeyPair(d *Driver, name string) (*keypairs.KeyPair, error) {
+	keyPairs, err := keypairs.GetAll(c.Compute).ExtractKeyPairs()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, kp := range keyPairs {
+		if kp.DisplayName == name {
+			return &keyPairs[i], nil
+		}
+	}
+	return nil, nil
+}
+
 func (c *GenericClient) DeleteKeyPair(d *Driver, id string) error {
 	if result := keypairs.Delete(c.Compute, id ); result.Err != nil {
 		return result.Err
@@ -313,116 +530,65 @@ func (c *GenericClient) GetServerDetail(d *Driver) (*servers.Server, error) {
 }
 
 
-//func (c *GenericClient) AssignFloatingIP(d *Driver, floatingIP *FloatingIP) error {
-//	if d.ComputeNetwork {
-//		return c.assignNovaFloatingIP(d, floatingIP)
-//	}
-//	return c.assignNeutronFloatingIP(d, floatingIP)
-//}
+func (c *GenericClient) AssignFloatingIP(d *Driver, floatingIP *FloatingIP) error {
+	if floatingIP.Id == "" {
+		f, err := floatingips.Create(c.Network, floatingips.CreateOpts{
+			AvailabilityZone: d.AvailabilityZone,
+			Pool:             d.FloatingIpPool,
+			Bandwidth:        d.Bandwidth,
+		}).Extract()
+		if err != nil {
+			return err
+		}
+		floatingIP.Id = f.ID
+		floatingIP.Ip = f.IP
+		floatingIP.Pool = f.Pool
+	}
+	if result := floatingips.Associate(c.Network, floatingIP.Id, d.MachineId); result.Err != nil {
+		return result.Err
+	}
+	floatingIP.MachineId = d.MachineId
+	return nil
+}
 
-//func (c *GenericClient) assignNovaFloatingIP(d *Driver, floatingIP *FloatingIP) error {
-//	if floatingIP.Ip == "" {
-//		f, err := compute_ips.Create(c.Compute, compute_ips.CreateOpts{
-//			Pool: d.FloatingIpPool,
-//		}).Extract()
-//		if err != nil {
-//			return err
-//		}
-//		floatingIP.Ip = f.IP
-//		floatingIP.Pool = f.Pool
-//	}
-//	return compute_ips.Associate(c.Compute, d.MachineId, floatingIP.Ip).Err
-//}
+func (c *GenericClient) GetFloatingIPs(d *Driver) ([]FloatingIP, error) {
+	log.Debug("Listing floating IPs", map[string]string{"Pool": d.FloatingIpPool})
+	ipList, err := floatingips.List(c.Network).Extract()
+	if err != nil {
+		return nil, err
+	}
 
-//func (c *GenericClient) assignNeutronFloatingIP(d *Driver, floatingIP *FloatingIP) error {
-//	portID, err := c.GetInstancePortID(d)
-//	if err != nil {
-//		return err
-//	}
-//	if floatingIP.Id == "" {
-//		f, err := floatingips.Create(c.Network, floatingips.CreateOpts{
-//			FloatingNetworkID: d.FloatingIpPoolId,
-//			PortID:            portID,
-//		}).Extract()
-//		if err != nil {
-//			return err
-//		}
-//		floatingIP.Id = f.ID
-//		floatingIP.Ip = f.FloatingIP
-//		floatingIP.NetworkId = f.FloatingNetworkID
-//		floatingIP.PortId = f.PortID
-//		return nil
-//	}
-//	_, err = floatingips.Update(c.Network, floatingIP.Id, floatingips.UpdateOpts{
-//		PortID: portID,
-//	}).Extract()
-//	if err != nil {
-//		return err
-//	}
-//	return nil
-//}
+	ips := []FloatingIP{}
+	for _, f := range ipList {
+		if d.FloatingIpPool != "" && f.Pool != d.FloatingIpPool {
+			continue
+		}
+		if f.Az != "" && f.Az != d.AvailabilityZone {
+			continue
+		}
+		ips = append(ips, FloatingIP{
+			Id:        f.ID,
+			Ip:        f.IP,
+			Pool:      f.Pool,
+			MachineId: f.ServerID,
+		})
+	}
+	return ips, nil
+}
 
-//func (c *GenericClient) GetFloatingIPs(d *Driver) ([]FloatingIP, error) {
-//	if d.ComputeNetwork {
-//		return c.getNovaNetworkFloatingIPs(d)
-//	}
-//	return c.getNeutronNetworkFloatingIPs(d)
-//}
-//
-//func (c *GenericClient) getNovaNetworkFloatingIPs(d *Driver) ([]FloatingIP, error) {
-//	pager := compute_ips.List(c.Compute)
-//
-//	ips := []FloatingIP{}
-//	err := pager.EachPage(func(page pagination.Page) (continue_paging bool, err error) {
-//		continue_paging, err = true, nil
-//		ipListing, err := compute_ips.ExtractFloatingIPs(page)
-//
-//		for _, ip := range ipListing {
-//			if ip.InstanceID == "" && ip.Pool == d.FloatingIpPool {
-//				ips = append(ips, FloatingIP{
-//					Id:   ip.ID,
-//					Ip:   ip.IP,
-//					Pool: ip.Pool,
-//				})
-//			}
-//		}
-//		return
-//	})
-//	return ips, err
-//}
-//
-//func (c *GenericClient) getNeutronNetworkFloatingIPs(d *Driver) ([]FloatingIP, error) {
-//	log.Debug("Listing floating IPs", map[string]string{
-//		"FloatingNetworkId": d.FloatingIpPoolId,
-//		"TenantID":          d.TenantId,
-//	})
-//	pager := floatingips.List(c.Network, floatingips.ListOpts{
-//		FloatingNetworkID: d.FloatingIpPoolId,
-//		TenantID:          d.TenantId,
-//	})
-//
-//	ips := []FloatingIP{}
-//	err := pager.EachPage(func(page pagination.Page) (bool, error) {
-//		floatingipList, err := floatingips.ExtractFloatingIPs(page)
-//		if err != nil {
-//			return false, err
-//		}
-//		for _, f := range floatingipList {
-//			ips = append(ips, FloatingIP{
-//				Id:        f.ID,
-//				Ip:        f.FloatingIP,
-//				NetworkId: f.FloatingNetworkID,
-//				PortId:    f.PortID,
-//			})
-//		}
-//		return true, nil
-//	})
-//
-//	if err != nil {
-//		return nil, err
-//	}
-//	return ips, nil
-//}
+func (c *GenericClient) DisassociateFloatingIP(d *Driver, id string) error {
+	if result := floatingips.Disassociate(c.Network, id); result.Err != nil {
+		return result.Err
+	}
+	return nil
+}
+
+func (c *GenericClient) ReleaseFloatingIP(d *Driver, id string) error {
+	if result := floatingips.Delete(c.Network, id); result.Err != nil {
+		return result.Err
+	}
+	return nil
+}
 
 //func (c *GenericClient) GetInstancePortID(d *Driver) (string, error) {
 //	pager := ports.List(c.Network, ports.ListOpts{
@@ -453,14 +619,52 @@ func (c *GenericClient) InitProviderClient(d *Driver) error {
     if c.Provider != nil {
         return nil
     }
+    retryPolicy := speedycloud.DefaultRetryPolicy
+    retryPolicy.MaxAttempts = d.ApiRetries + 1
     provider := &speedycloud.ProviderClient{
         ApiKey: d.ApiKey,
         ApiSecret: d.ApiSecret,
+        ApiToken: d.ApiToken,
+        RetryPolicy: retryPolicy,
+    }
+    transport, err := newTransport(d)
+    if err != nil {
+        return err
+    }
+    provider.HTTPClient.Transport = transport
+    if wrapTransport != nil {
+        provider.HTTPClient.Transport = wrapTransport(d, transport)
+    }
+    if traceEnabled() {
+        provider.HTTPClient.Transport = &speedycloud.TraceTransport{
+            Transport: provider.HTTPClient.Transport,
+            Logf:      log.Debugf,
+            Secrets:   []string{d.ApiSecret, d.ApiToken},
+        }
+    }
+    if d.TokenAuth && d.ApiToken == "" {
+        opts := tokens.CreateOpts{TTL: d.TokenTTL, Scope: d.TokenScope}
+        cache := &tokens.FileCache{Path: tokenCachePath(d.SpeedCloudUrl, d.ApiKey, d.TokenScope)}
+        if err := tokens.Authenticate(provider, d.SpeedCloudUrl, opts, cache); err != nil {
+            return err
+        }
     }
     c.Provider = provider
     return nil
 }
 
+// traceEnabled reports whether the API calls should be dumped to the debug
+// log. docker-machine sets MACHINE_DEBUG in its driver plugins and only shows
+// their debug output when run with --debug; SPEED_CLOUD_DEBUG turns tracing on
+// when the driver is used directly.
+// wrapTransport, when set, wraps the transport of the API clients, beneath
+// the trace. Tests set it to record the API interactions in a cassette.
+var wrapTransport func(d *Driver, transport http.RoundTripper) http.RoundTripper
+
+func traceEnabled() bool {
+    return os.Getenv("SPEED_CLOUD_DEBUG") != "" || os.Getenv("MACHINE_DEBUG") != ""
+}
+
 func (c *GenericClient) InitComputeClient(d *Driver) error {
 	if c.Compute != nil {
 		return nil
@@ -537,28 +741,43 @@ func (c *GenericClient) InitNetworkClient(d *Driver) error {
 //	return nil
 //}
 
-//func (c *GenericClient) SetTLSConfig(d *Driver) error {
-//
-//	config := &tls.Config{}
-//	config.InsecureSkipVerify = d.Insecure
-//
-//	if d.CaCert != "" {
-//		// Use custom CA certificate(s) for root of trust
-//		certpool := x509.NewCertPool()
-//		pem, err := ioutil.ReadFile(d.CaCert)
-//		if err != nil {
-//			log.Error("Unable to read specified CA certificate(s)")
-//			return err
-//		}
-//
-//		ok := certpool.AppendCertsFromPEM(pem)
-//		if !ok {
-//			return fmt.Errorf("Ill-formed CA certificate(s) PEM file")
-//		}
-//		config.RootCAs = certpool
-//	}
-//
-//	transport := &http.Transport{TLSClientConfig: config}
-//	c.Provider.HTTPClient.Transport = transport
-//	return nil
-//}
+// newTransport builds the HTTP transport of the API client from the TLS and
+// proxy options of the driver.
+func newTransport(d *Driver) (*http.Transport, error) {
+	config := &tls.Config{}
+	config.InsecureSkipVerify = d.Insecure
+
+	if d.CaCert != "" {
+		// Use custom CA certificate(s) for root of trust
+		certpool := x509.NewCertPool()
+		pem, err := ioutil.ReadFile(d.CaCert)
+		if err != nil {
+			return nil, fmt.Errorf(errorInvalidCaCert, d.CaCert, err)
+		}
+
+		ok := certpool.AppendCertsFromPEM(pem)
+		if !ok {
+			return nil, fmt.Errorf(errorInvalidCaCert, d.CaCert, "ill-formed PEM file")
+		}
+		config.RootCAs = certpool
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if d.Proxy != "" {
+		proxyURL, err := url.Parse(d.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf(errorInvalidURL, "Proxy", d.Proxy)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSClientConfig:     config,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}, nil
+}
@@ -0,0 +1,420 @@
+package speedycloud
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/hna/speedycloud"
+	"github.com/hna/speedycloud/computing/v2/keypairs"
+	"github.com/hna/speedycloud/computing/v2/servers"
+	"github.com/hna/speedycloud/identity/v1/tokens"
+	"github.com/hna/speedycloud/pagination"
+	"github.com/hna/speedycloud/testhelper"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// attempt is a request as received by a test server.
+type attempt struct {
+	at            time.Time
+	date          string
+	authorization string
+	body          string
+}
+
+// recordingServer answers the successive requests it receives with the given
+// handlers, the last one answering every remaining request.
+type recordingServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	attempts []attempt
+}
+
+func newRecordingServer(handlers ...http.HandlerFunc) *recordingServer {
+	s := &recordingServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.attempts = append(s.attempts, attempt{
+			at:            time.Now(),
+			date:          r.Header.Get("Date"),
+			authorization: r.Header.Get("Authorization"),
+			body:          string(body),
+		})
+		handler := handlers[len(handlers)-1]
+		if len(s.attempts) <= len(handlers) {
+			handler = handlers[len(s.attempts)-1]
+		}
+		s.mu.Unlock()
+		handler(w, r)
+	}))
+	return s
+}
+
+func (s *recordingServer) Attempts() []attempt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]attempt(nil), s.attempts...)
+}
+
+func respond(status int, header ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i+1 < len(header); i += 2 {
+			w.Header().Set(header[i], header[i+1])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(`{}`))
+	}
+}
+
+func newRetryingProvider() *speedycloud.ProviderClient {
+	return &speedycloud.ProviderClient{
+		ApiKey:    "key",
+		ApiSecret: "secret",
+		RetryPolicy: speedycloud.RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Millisecond,
+			MaxDelay:    2 * time.Second,
+		},
+	}
+}
+
+func TestRetryThrottledRequests(t *testing.T) {
+	server := newRecordingServer(
+		respond(http.StatusTooManyRequests, "Retry-After", "1"),
+		respond(http.StatusServiceUnavailable),
+		respond(http.StatusOK),
+	)
+	defer server.Close()
+
+	provider := newRetryingProvider()
+	payload := "alias=web%20server&group=docker&bootscript=%23%21%2Fbin%2Fsh%0A"
+	_, err := provider.Post(server.URL+"/api/v1/products/cloud_servers/1/alias", strings.NewReader(payload), nil, nil)
+	assert.NoError(t, err)
+
+	attempts := server.Attempts()
+	assert.Len(t, attempts, 3)
+	assert.True(t, attempts[1].at.Sub(attempts[0].at) >= time.Second, "Retry-After is not honored")
+	assert.NotEqual(t, attempts[0].date, attempts[1].date)
+	for _, a := range attempts {
+		assert.Equal(t, payload, a.body)
+		sign := provider.CreateSign(a.date, "/api/v1/products/cloud_servers/1/alias", "POST")
+		assert.Equal(t, "key,"+sign, a.authorization)
+	}
+}
+
+func TestRetryServerErrors(t *testing.T) {
+	server := newRecordingServer(respond(http.StatusInternalServerError))
+	defer server.Close()
+	provider := newRetryingProvider()
+
+	_, err := provider.Post(server.URL, strings.NewReader("id=1"), nil, nil)
+	assert.IsType(t, &speedycloud.APIError{}, err)
+	assert.Equal(t, http.StatusInternalServerError, err.(*speedycloud.APIError).StatusCode)
+	assert.Len(t, server.Attempts(), 1)
+
+	_, err = provider.Post(server.URL, strings.NewReader("id=1"), nil, &speedycloud.RequestOpts{Idempotent: true})
+	assert.Error(t, err)
+	assert.Len(t, server.Attempts(), 4)
+}
+
+// failingTransport fails every request after the connection is established.
+type failingTransport struct {
+	attempts int
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.attempts++
+	return nil, errors.New("connection reset by peer")
+}
+
+func TestRetryTransportErrors(t *testing.T) {
+	transport := &failingTransport{}
+	provider := newRetryingProvider()
+	provider.HTTPClient.Transport = transport
+
+	_, err := provider.Post("http://api.example.com/", strings.NewReader("id=1"), nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 1, transport.attempts)
+
+	_, err = provider.Post("http://api.example.com/", strings.NewReader("id=1"), nil, &speedycloud.RequestOpts{Idempotent: true})
+	assert.Error(t, err)
+	assert.Equal(t, 4, transport.attempts)
+}
+
+func TestRetryFakeAPIFailures(t *testing.T) {
+	api := testhelper.NewFakeAPI("key", "secret")
+	defer api.Close()
+	provider := newRetryingProvider()
+	compute, err := speedycloud.NewComputeV2(provider, api.URL)
+	assert.NoError(t, err)
+
+	api.FailNext("sshkey", http.StatusServiceUnavailable, "ServiceUnavailable", "Try again later")
+	_, err = keypairs.GetAll(compute).ExtractKeyPairs()
+	assert.NoError(t, err)
+
+	api.FailNext("sshkey/create", http.StatusInternalServerError, "InternalError", "Database unavailable")
+	err = keypairs.Create(compute, keypairs.CreateOpts{DisplayName: "docker", PublicKey: "ssh-rsa AAAA docker"}).Err
+	assert.IsType(t, &speedycloud.APIError{}, err)
+	assert.Equal(t, "InternalError", err.(*speedycloud.APIError).Code)
+	assert.Empty(t, api.KeyPairs())
+}
+
+// recordAPICalls records the API calls of the drivers initialized until stop
+// is called in a cassette stored at path.
+func recordAPICalls(t *testing.T, path string) (cassette *speedycloud.Cassette, stop func()) {
+	cassette, err := speedycloud.OpenCassette(path, speedycloud.CassetteRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapTransport = func(d *Driver, transport http.RoundTripper) http.RoundTripper {
+		cassette.Transport = transport
+		cassette.Secrets = []string{d.ApiSecret, d.ApiToken}
+		return cassette
+	}
+	return cassette, func() { wrapTransport = nil }
+}
+
+func TestTokenRenewal(t *testing.T) {
+	api := testhelper.NewFakeAPI("key", "secret")
+	defer api.Close()
+
+	home, err := ioutil.TempDir("", "speedycloud")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+	cassette, stop := recordAPICalls(t, filepath.Join(home, "cassette.json"))
+	defer stop()
+
+	driver := NewDerivedDriver("default", "path")
+	driver.SpeedCloudUrl = api.URL
+	driver.ApiKey = "key"
+	driver.ApiSecret = "secret"
+	driver.TokenAuth = true
+	assert.NoError(t, driver.initCompute())
+
+	cache := &tokens.FileCache{Path: tokenCachePath(api.URL, "key", "")}
+	first, err := cache.Load()
+	assert.NoError(t, err)
+	provider := driver.client.(*GenericClient).Provider
+	assert.Equal(t, first.ID, provider.ApiToken)
+
+	_, err = driver.client.GetKeyPair(driver, "docker")
+	assert.NoError(t, err)
+	api.ExpireTokens()
+	_, err = driver.client.GetKeyPair(driver, "docker")
+	assert.NoError(t, err)
+
+	calls := []string{}
+	for _, interaction := range cassette.Interactions() {
+		path := strings.TrimPrefix(interaction.Request.Path, "/api/v1/products/")
+		calls = append(calls, fmt.Sprintf("%s %d", path, interaction.Response.StatusCode))
+	}
+	assert.Equal(t, []string{
+		"tokens/provision 200",
+		"sshkey 200",
+		"sshkey 401",
+		"tokens/provision 200",
+		"sshkey 200",
+	}, calls)
+
+	renewed, err := cache.Load()
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.ID, renewed.ID)
+	assert.Equal(t, renewed.ID, provider.ApiToken)
+
+	assert.NotEqual(t, tokenCachePath(api.URL, "key", ""), tokenCachePath(defaultURL, "key", ""))
+}
+
+func TestTraceRedaction(t *testing.T) {
+	api := testhelper.NewFakeAPI("key", "s3cr3t-value")
+	defer api.Close()
+
+	home, err := ioutil.TempDir("", "speedycloud")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+	os.Setenv("SPEED_CLOUD_DEBUG", "1")
+	defer os.Unsetenv("SPEED_CLOUD_DEBUG")
+
+	var trace bytes.Buffer
+	log.SetDebug(true)
+	log.SetErrWriter(&trace)
+	defer log.SetDebug(false)
+	defer log.SetErrWriter(os.Stderr)
+
+	// The token is created with the key and secret, then sent in place of the signature.
+	driver := NewDerivedDriver("default", "path")
+	driver.SpeedCloudUrl = api.URL
+	driver.ApiKey = "key"
+	driver.ApiSecret = "s3cr3t-value"
+	driver.TokenAuth = true
+	assert.NoError(t, driver.initCompute())
+	_, err = driver.client.GetKeyPair(driver, "docker")
+	assert.NoError(t, err)
+	token := driver.client.(*GenericClient).Provider.ApiToken
+
+	// A token given by the user is never signed with, but must not leak either.
+	driver = NewDerivedDriver("default", "path")
+	driver.SpeedCloudUrl = api.URL
+	driver.ApiToken = token
+	assert.NoError(t, driver.initCompute())
+	_, err = driver.client.GetKeyPair(driver, "docker")
+	assert.NoError(t, err)
+
+	assert.Contains(t, trace.String(), "SpeedyCloud request:")
+	assert.Contains(t, trace.String(), "Authorization: <REDACTED>")
+	assert.NotContains(t, trace.String(), "s3cr3t-value")
+	assert.NotContains(t, trace.String(), token)
+	for _, line := range strings.Split(trace.String(), "\n") {
+		if strings.HasPrefix(line, "Authorization:") {
+			assert.Equal(t, "Authorization: <REDACTED>", line)
+		}
+	}
+}
+
+// countingTransport counts the requests going through it.
+type countingTransport struct {
+	http.RoundTripper
+	requests int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func TestListServers(t *testing.T) {
+	api := testhelper.NewFakeAPI("key", "secret")
+	defer api.Close()
+	provider := &speedycloud.ProviderClient{ApiKey: "key", ApiSecret: "secret"}
+	transport := &countingTransport{RoundTripper: http.DefaultTransport}
+	provider.HTTPClient.Transport = transport
+	compute, err := speedycloud.NewComputeV2(provider, api.URL)
+	assert.NoError(t, err)
+
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		server, err := servers.Create(compute, servers.CreateOpts{
+			AvailabilityZone: defaultAvailabilityZone,
+			ImageName:        defaultImage,
+			CpuNumber:        defaultCpuNumber,
+			Memory:           defaultMemory,
+		}).Extract()
+		assert.NoError(t, err)
+		ids = append(ids, server.ID)
+	}
+	for _, id := range ids[:3] {
+		assert.NoError(t, servers.Group(compute, id, "docker").Err)
+	}
+	assert.NoError(t, servers.Alias(compute, ids[0], "manager").Err)
+
+	// list walks the pages of servers matching opts, returning the IDs found
+	// on each page and the number of pages requested.
+	list := func(opts servers.ListOpts) ([][]string, int) {
+		pages := [][]string{}
+		transport.requests = 0
+		err := servers.List(compute, opts).EachPage(func(page pagination.Page) (bool, error) {
+			serverList, err := servers.ExtractServers(page)
+			if err != nil {
+				return false, err
+			}
+			found := []string{}
+			for _, server := range serverList {
+				found = append(found, server.ID)
+			}
+			pages = append(pages, found)
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return pages, transport.requests
+	}
+
+	// A short page ends the walk.
+	pages, requests := list(servers.ListOpts{PageSize: 2})
+	assert.Equal(t, [][]string{{ids[4], ids[3]}, {ids[2], ids[1]}, {ids[0]}}, pages)
+	assert.Equal(t, 3, requests)
+
+	// So does an empty page, when the last page is full.
+	pages, requests = list(servers.ListOpts{PageSize: 5})
+	assert.Equal(t, [][]string{{ids[4], ids[3], ids[2], ids[1], ids[0]}}, pages)
+	assert.Equal(t, 2, requests)
+
+	pages, _ = list(servers.ListOpts{GroupName: "docker", PageSize: 2})
+	assert.Equal(t, [][]string{{ids[2], ids[1]}, {ids[0]}}, pages)
+	pages, _ = list(servers.ListOpts{GroupName: "docker", Alias: "manager"})
+	assert.Equal(t, [][]string{{ids[0]}}, pages)
+	pages, _ = list(servers.ListOpts{Status: testhelper.StatusRunning, AvailabilityZone: defaultAvailabilityZone})
+	assert.Len(t, pages, 1)
+	assert.Len(t, pages[0], 5)
+	pages, requests = list(servers.ListOpts{Status: testhelper.StatusStopped})
+	assert.Empty(t, pages)
+	assert.Equal(t, 1, requests)
+
+	// The handler stops the walk early.
+	transport.requests = 0
+	count := 0
+	err = servers.List(compute, servers.ListOpts{PageSize: 2}).EachPage(func(page pagination.Page) (bool, error) {
+		count++
+		return false, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 1, transport.requests)
+}
+
+func TestContextCancellation(t *testing.T) {
+	release := make(chan struct{})
+	server := newRecordingServer(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer server.Close()
+	defer close(release)
+
+	provider := newRetryingProvider()
+	compute, err := speedycloud.NewComputeV2(provider, server.URL+"/api/v1/products/")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = keypairs.GetAllContext(ctx, compute).ExtractKeyPairs()
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second, "The request in flight is not abandoned")
+	assert.Len(t, server.Attempts(), 1)
+
+	api := testhelper.NewFakeAPI("key", "secret")
+	defer api.Close()
+	compute, err = speedycloud.NewComputeV2(newRetryingProvider(), api.URL)
+	assert.NoError(t, err)
+	api.HangNextJob("provision")
+	created, err := servers.Create(compute, servers.CreateOpts{
+		AvailabilityZone: defaultAvailabilityZone,
+		ImageName:        defaultImage,
+		CpuNumber:        defaultCpuNumber,
+		Memory:           defaultMemory,
+	}).Extract()
+	assert.NoError(t, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	err = servers.WaitForStatusContext(ctx, compute, created.ID, testhelper.StatusRunning, 600)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second, "The poll is not abandoned")
+}
@@ -0,0 +1,263 @@
+package speedycloud
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/go-ini/ini"
+)
+
+const (
+	defaultProfile  = "default"
+	apiKeyEnvVar    = "SPEED_CLOUD_API_KEY"
+	apiSecretEnvVar = "SPEED_CLOUD_API_SECRET"
+	apiTokenEnvVar  = "SPEED_CLOUD_API_TOKEN"
+
+	// migrateCredentialsEnvVar opts the machines that still store their
+	// secret into resolving it at runtime, see UnmarshalJSON.
+	migrateCredentialsEnvVar = "SPEED_CLOUD_MIGRATE_CREDENTIALS"
+)
+
+// credentialsProfile holds the settings of one section of the credentials
+// file. Empty fields are left to the flags and built-in defaults.
+//
+// Example of $HOME/.speedycloud/credentials:
+//
+//	[default]
+//	api_key = <api key>
+//	api_secret = <api secret>
+//
+//	[staging]
+//	api_key = <api key>
+//	api_secret = <api secret>
+//	url = https://api.staging.speedycloud.cn/api/v1/products
+//	availability_zone = SPC-BJ-15-A
+type credentialsProfile struct {
+	ApiKey           string
+	ApiSecret        string
+	Url              string
+	AvailabilityZone string
+}
+
+// defaultCredentialsFile returns the path of the credentials file used when
+// none is given.
+func defaultCredentialsFile() string {
+	return filepath.Join(mcnutils.GetHomeDir(), ".speedycloud", "credentials")
+}
+
+// tokenCachePath returns the file caching the tokens created for an API key
+// and scope on an endpoint, so that machines sharing credentials share their
+// token, but the tokens of different endpoints never mix.
+func tokenCachePath(apiURL, apiKey, scope string) string {
+	sum := sha1.Sum([]byte(apiURL + "\n" + apiKey + "\n" + scope))
+	return filepath.Join(mcnutils.GetHomeDir(), ".speedycloud", "tokens", hex.EncodeToString(sum[:])+".json")
+}
+
+// loadProfile reads a profile from the credentials file. A missing file is
+// only an error when a profile was explicitly requested.
+func loadProfile(filename, profile string) (*credentialsProfile, error) {
+	explicit := profile != ""
+	if !explicit {
+		profile = defaultProfile
+	}
+	if filename == "" {
+		filename = defaultCredentialsFile()
+	}
+
+	if _, err := os.Stat(filename); os.IsNotExist(err) && !explicit {
+		return &credentialsProfile{}, nil
+	}
+
+	config, err := ini.Load(filename)
+	if err != nil {
+		return nil, fmt.Errorf(errorCredentialsFile, filename, err)
+	}
+	section, err := config.GetSection(profile)
+	if err != nil {
+		if !explicit {
+			return &credentialsProfile{}, nil
+		}
+		return nil, fmt.Errorf(errorUnknownProfile, profile, filename)
+	}
+
+	return &credentialsProfile{
+		ApiKey:           section.Key("api_key").String(),
+		ApiSecret:        section.Key("api_secret").String(),
+		Url:              section.Key("url").String(),
+		AvailabilityZone: section.Key("availability_zone").String(),
+	}, nil
+}
+
+// applyProfile fills the settings that were not given as flags or environment
+// variables from the profile, then from the built-in defaults. The credentials
+// of a credential helper are left to the helper, even when a profile exists.
+func (d *Driver) applyProfile(profile *credentialsProfile) {
+	if d.CredentialSource != credentialSourceHelper {
+		if d.ApiKey == "" {
+			d.ApiKey = profile.ApiKey
+		}
+		if d.ApiSecret == "" {
+			d.ApiSecret = profile.ApiSecret
+		}
+	}
+	if d.SpeedCloudUrl == "" {
+		d.SpeedCloudUrl = profile.Url
+	}
+	if d.SpeedCloudUrl == "" {
+		d.SpeedCloudUrl = defaultURL
+	}
+	if d.AvailabilityZone == "" {
+		d.AvailabilityZone = profile.AvailabilityZone
+	}
+	if d.AvailabilityZone == "" {
+		d.AvailabilityZone = defaultAvailabilityZone
+	}
+}
+
+// These constants tell where the API key and secret of a machine come from.
+// Only credentialSourceConfig, or the empty source of the machines created
+// before the others existed, keeps the secret in the machine configuration;
+// the other sources are resolved again every time the driver is loaded.
+const (
+	credentialSourceConfig  = "config"
+	credentialSourceEnv     = "env"
+	credentialSourceProfile = "profile"
+	credentialSourceHelper  = "helper"
+)
+
+// persistsCredentials reports whether the API key and secret are stored in
+// the machine configuration.
+func (d *Driver) persistsCredentials() bool {
+	return d.CredentialSource == "" || d.CredentialSource == credentialSourceConfig
+}
+
+// MarshalJSON leaves the API key and secret out of the machine configuration
+// when they can be resolved at runtime. A static API token is short-lived and
+// never stored.
+func (d *Driver) MarshalJSON() ([]byte, error) {
+	type driver Driver
+	persisted := driver(*d)
+	if !d.persistsCredentials() {
+		persisted.ApiKey = ""
+		persisted.ApiSecret = ""
+	}
+	persisted.ApiToken = ""
+	return json.Marshal(persisted)
+}
+
+// UnmarshalJSON loads a machine configuration. The machines that still store
+// their secret keep it, unless SPEED_CLOUD_MIGRATE_CREDENTIALS is set and the
+// same credentials are available from the environment or the profile: they
+// then resolve them at runtime, and the next save drops the secret.
+func (d *Driver) UnmarshalJSON(data []byte) error {
+	type driver Driver
+	if err := json.Unmarshal(data, (*driver)(d)); err != nil {
+		return err
+	}
+	if d.CredentialSource == "" && d.ApiKey != "" && os.Getenv(migrateCredentialsEnvVar) != "" {
+		d.CredentialSource = d.migratedCredentialSource()
+		log.Infof("Credential source of machine %s: %s", d.MachineName, d.CredentialSource)
+	}
+	return nil
+}
+
+func (d *Driver) migratedCredentialSource() string {
+	if os.Getenv(apiKeyEnvVar) == d.ApiKey && os.Getenv(apiSecretEnvVar) == d.ApiSecret {
+		return credentialSourceEnv
+	}
+	profile, err := loadProfile(d.CredentialsFile, d.Profile)
+	if err == nil && profile.ApiKey == d.ApiKey && profile.ApiSecret == d.ApiSecret {
+		return credentialSourceProfile
+	}
+	return credentialSourceConfig
+}
+
+// credentialSource tells where the credentials given at creation come from.
+// flagKey and flagSecret are the values of the flags or of their environment
+// variables, before the profile is applied. The key and the secret must come
+// from the same place: a key from the command line with a secret from the
+// profile, or the reverse, is refused rather than stored.
+func (d *Driver) credentialSource(flagKey, flagSecret string) (string, error) {
+	switch {
+	case d.CredentialHelper != "":
+		return credentialSourceHelper, nil
+	case flagKey == "" && flagSecret == "":
+		return credentialSourceProfile, nil
+	case flagKey == "" || flagSecret == "":
+		return "", errors.New(errorMixedCredentials)
+	case flagKey == os.Getenv(apiKeyEnvVar) && flagSecret == os.Getenv(apiSecretEnvVar):
+		return credentialSourceEnv, nil
+	}
+	log.Warn("The api secret given on the command line is stored in the machine configuration, use a profile, environment variables or a credential helper to avoid it")
+	return credentialSourceConfig, nil
+}
+
+// resolveCredentials loads the API key and secret that were not persisted
+// with the machine. They are not needed when a static API token is given.
+func (d *Driver) resolveCredentials() error {
+	if d.ApiToken == "" {
+		d.ApiToken = os.Getenv(apiTokenEnvVar)
+	}
+	if d.ApiToken != "" && !d.TokenAuth {
+		return nil
+	}
+	if d.persistsCredentials() || (d.ApiKey != "" && d.ApiSecret != "") {
+		return nil
+	}
+
+	switch d.CredentialSource {
+	case credentialSourceEnv:
+		d.ApiKey = os.Getenv(apiKeyEnvVar)
+		d.ApiSecret = os.Getenv(apiSecretEnvVar)
+	case credentialSourceProfile:
+		profile, err := loadProfile(d.CredentialsFile, d.Profile)
+		if err != nil {
+			return err
+		}
+		d.ApiKey = profile.ApiKey
+		d.ApiSecret = profile.ApiSecret
+	case credentialSourceHelper:
+		key, secret, err := runCredentialHelper(d.CredentialHelper)
+		if err != nil {
+			return err
+		}
+		d.ApiKey = key
+		d.ApiSecret = secret
+	}
+
+	if d.ApiKey == "" || d.ApiSecret == "" {
+		return fmt.Errorf(errorUnresolvedCredentials, d.CredentialSource)
+	}
+	return nil
+}
+
+// runCredentialHelper runs an external command that prints the API key on its
+// first line and the API secret on its second line.
+func runCredentialHelper(command string) (string, string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", "", fmt.Errorf(errorCredentialHelper, command, "empty command")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf(errorCredentialHelper, command, err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) < 2 {
+		return "", "", fmt.Errorf(errorCredentialHelper, command, "expected the api key and the api secret on two lines")
+	}
+	return strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1]), nil
+}
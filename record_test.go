@@ -0,0 +1,60 @@
+//go:build cassette
+// +build cassette
+
+package speedycloud
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hna/speedycloud"
+	"github.com/hna/speedycloud/computing/v2/keypairs"
+	"github.com/hna/speedycloud/computing/v2/servers"
+	"github.com/hna/speedycloud/testhelper"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// TestRecordFixture records the payloads TestCassetteFixture decodes, against
+// the API of SPEED_CLOUD_URL with the credentials of SPEED_CLOUD_API_KEY and
+// SPEED_CLOUD_API_SECRET, or against the fake API when they are not set:
+//
+//	go test -tags cassette -run TestRecordFixture .
+//
+// The keypair and the server it creates are deleted afterwards.
+func TestRecordFixture(t *testing.T) {
+	endpoint := os.Getenv("SPEED_CLOUD_URL")
+	key, secret := os.Getenv(apiKeyEnvVar), os.Getenv(apiSecretEnvVar)
+	if endpoint == "" {
+		key, secret = "fixture-api-key", "fixture-api-secret"
+		api := testhelper.NewFakeAPI(key, secret)
+		defer api.Close()
+		endpoint = api.URL
+	}
+
+	path := filepath.Join("testdata", "compute.json")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	recorder, err := speedycloud.OpenCassette(path, speedycloud.CassetteRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Secrets = []string{secret}
+	keyPair, server := exerciseCompute(t, recorder, endpoint, key, secret)
+
+	compute, err := speedycloud.NewComputeV2(&speedycloud.ProviderClient{ApiKey: key, ApiSecret: secret}, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller := speedycloud.NewPoller(10 * time.Minute)
+	assert.NoError(t, servers.PollStatus(context.Background(), compute, server.ID, "Running", poller))
+	assert.NoError(t, servers.Delete(compute, server.ID).Err)
+	assert.NoError(t, speedycloud.WaitFor(600, func() (bool, error) {
+		err := servers.Get(compute, server.ID).Err
+		return speedycloud.IsNotFound(err), nil
+	}))
+	assert.NoError(t, keypairs.Delete(compute, keyPair.ID).Err)
+}
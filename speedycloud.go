@@ -1,30 +1,52 @@
 package speedycloud
 
 import (
-    "fmt"
-    "io/ioutil"
-    "net"
-    "strings"
-    "time"
-
-    "github.com/docker/machine/libmachine/drivers"
-    "github.com/docker/machine/libmachine/log"
-    "github.com/docker/machine/libmachine/mcnflag"
-    "github.com/docker/machine/libmachine/mcnutils"
-    "github.com/docker/machine/libmachine/ssh"
-    "github.com/docker/machine/libmachine/state"
-    "regexp"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/docker/machine/libmachine/ssh"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/hna/speedycloud"
+	"github.com/hna/speedycloud/computing/v2/snapshots"
+	"github.com/hna/speedycloud/computing/v2/volumes"
+	"golang.org/x/net/context"
 )
 
 type Driver struct {
     *drivers.BaseDriver
     ActiveTimeout    int
+    JobTimeout       int
+    StopTimeout      int
+    RestartMethod    string
+    ApiRetries       int
     SpeedCloudUrl    string
+    Insecure         bool
+    CaCert           string
+    Proxy            string
     ApiKey           string
     ApiSecret        string
+    Profile          string
+    CredentialsFile  string
+    CredentialHelper string
+    CredentialSource string
+    ApiToken         string
+    TokenAuth        bool
+    TokenTTL         int
+    TokenScope       string
     AvailabilityZone string
     MachineId        string
     KeyPairName      string
+    KeyPairGenerated bool
     NetworkName      string
     UserData         string
     PrivateKeyFile   string
@@ -35,20 +57,34 @@ type Driver struct {
     Isp              string
     Bandwidth        int
     ImageType        string
+    SnapshotId       string
     IpType           string
+    IpCidr           string
     GroupName        string
+    KeepOnFailure    bool
+    SecurityGroups   []string
+    Volumes          []string
+    VolumeIds        []string
+    DeleteVolumes    bool
+    FloatingIpPool   string
+    FloatingIp       string
+    FloatingIpId     string
     client           Client
 }
 
 const (
-    defaultURL = "http://api.speedycloud.cn/api/v1/products"
+    defaultURL = "https://api.speedycloud.cn/api/v1/products"
     defaultSSHUser = "root"
     defaultSSHPort = 22
     defaultActiveTimeout = 200
+    defaultJobTimeout = 300
+    defaultStopTimeout = 60
+    defaultRestartMethod = "soft"
+    defaultApiRetries = 3
+    defaultTokenTTL = 3600
     defaultKeyPairName = "cloudos"
+    generatedKeyPairTag = "docker-machine-speedycloud"
     defaultAvailabilityZone = "SPC-BJ-15-A"
-    defaultAPISecret = "26685451e2a302886fb2a53958a787f65d3433731bee56d8f7fe96a714f677db"
-    defaultAPIKey = "A44384F4AE3998DFEEAFD5E6CC6B1D56"
     defaultKeyFile = "/tmp/cloudos"
     defaultNetworkName = ""
     defaultCpuNumber = 2
@@ -58,9 +94,12 @@ const (
     defaultISP = "Private"
     defaultBandwidth = 2
     defaultImage = "Ubuntu 14.04"
+    snapshotImagePrefix = "snapshot:"
     defaultIpType = "inner"
-    defaultUserDate = "/tmp/userdata"
     defaultGroupName = "cloudos"
+    defaultSecurityGroup = "docker-machine"
+    dockerPort = 2376
+    swarmPort = 3376
 )
 
 func (d *Driver) GetCreateFlags() []mcnflag.Flag {
@@ -68,20 +107,78 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
         mcnflag.StringFlag{
             EnvVar: "SPEED_CLOUD_URL",
             Name:   "speedycloud-url",
-            Usage:  "SpeedyCloud URL",
-            Value:  defaultURL,
+            Usage:  "SpeedyCloud URL, " + defaultURL + " unless set by the profile",
+            Value:  "",
+        },
+        mcnflag.BoolFlag{
+            EnvVar: "SPEED_CLOUD_INSECURE",
+            Name:   "speedycloud-insecure",
+            Usage:  "Disable TLS certificate verification of the SpeedyCloud API",
+        },
+        mcnflag.StringFlag{
+            EnvVar: "SPEED_CLOUD_CACERT",
+            Name:   "speedycloud-cacert",
+            Usage:  "CA certificate bundle used to verify the SpeedyCloud API",
+            Value:  "",
         },
         mcnflag.StringFlag{
-            EnvVar: "SPEED_CLOUD_API_KEY",
+            EnvVar: "SPEED_CLOUD_PROXY",
+            Name:   "speedycloud-proxy",
+            Usage:  "HTTP proxy URL used to reach the SpeedyCloud API, instead of HTTPS_PROXY/HTTP_PROXY",
+            Value:  "",
+        },
+        mcnflag.StringFlag{
+            EnvVar: apiKeyEnvVar,
             Name:   "speedycloud-api-key",
-            Usage:  "SpeedyCloud api key",
-            Value:  defaultAPIKey,
+            Usage:  "SpeedyCloud api key, read from the credentials file when not set",
+            Value:  "",
         },
         mcnflag.StringFlag{
-            EnvVar: "SPEED_CLOUD_API_SECRET",
+            EnvVar: apiSecretEnvVar,
             Name:   "speedycloud-api-secret",
-            Usage:  "SpeedyCloud password",
-            Value:  defaultAPISecret,
+            Usage:  "SpeedyCloud api secret, read from the credentials file when not set",
+            Value:  "",
+        },
+        mcnflag.StringFlag{
+            EnvVar: "SPEED_CLOUD_PROFILE",
+            Name:   "speedycloud-profile",
+            Usage:  "Profile of the credentials file to use, default when not set",
+            Value:  "",
+        },
+        mcnflag.StringFlag{
+            EnvVar: "SPEED_CLOUD_CREDENTIALS_FILE",
+            Name:   "speedycloud-credentials-file",
+            Usage:  "SpeedyCloud credentials file, $HOME/.speedycloud/credentials when not set",
+            Value:  "",
+        },
+        mcnflag.StringFlag{
+            EnvVar: apiTokenEnvVar,
+            Name:   "speedycloud-api-token",
+            Usage:  "Short-lived SpeedyCloud api token, used instead of the api key and secret",
+            Value:  "",
+        },
+        mcnflag.BoolFlag{
+            EnvVar: "SPEED_CLOUD_TOKEN_AUTH",
+            Name:   "speedycloud-token-auth",
+            Usage:  "Authenticate with short-lived tokens created from the api key and secret and cached in $HOME/.speedycloud/tokens",
+        },
+        mcnflag.IntFlag{
+            EnvVar: "SPEED_CLOUD_TOKEN_TTL",
+            Name:   "speedycloud-token-ttl",
+            Usage:  "Lifetime in seconds of the tokens created by --speedycloud-token-auth",
+            Value:  defaultTokenTTL,
+        },
+        mcnflag.StringFlag{
+            EnvVar: "SPEED_CLOUD_TOKEN_SCOPE",
+            Name:   "speedycloud-token-scope",
+            Usage:  "Scope the tokens created by --speedycloud-token-auth are restricted to",
+            Value:  "",
+        },
+        mcnflag.StringFlag{
+            EnvVar: "SPEED_CLOUD_CREDENTIAL_HELPER",
+            Name:   "speedycloud-credential-helper",
+            Usage:  "Command printing the api key and the api secret on two lines, run whenever the credentials are needed",
+            Value:  "",
         },
         mcnflag.StringFlag{
             EnvVar: "SPEED_CLOUD_KEYPAIR_NAME",
@@ -92,8 +189,8 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
         mcnflag.StringFlag{
             EnvVar: "SPEED_CLOUD_AVAILABILITY_ZONE",
             Name:   "speedycloud-availability-zone",
-            Usage:  "SpeedyCloud zone where to create the instance ",
-            Value:  defaultAvailabilityZone,
+            Usage:  "SpeedyCloud zone where to create the instance, " + defaultAvailabilityZone + " unless set by the profile",
+            Value:  "",
         },
         mcnflag.StringFlag{
             EnvVar: "SPEED_CLOUD_PRIVATE_KEY_FILE",
@@ -105,7 +202,7 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
             EnvVar: "SPEED_CLOUD_USER_DATA_FILE",
             Name:   "speedycloud-user-data-file",
             Usage:  "File containing an SpeedyCloud userdata script",
-            Value:  defaultUserDate,
+            Value:  "",
         },
         mcnflag.StringFlag{
             EnvVar: "SPEED_CLOUD_NETWORK_NAME",
@@ -132,6 +229,30 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
             Usage:  "SpeedyCloud active timeout",
             Value:  defaultActiveTimeout,
         },
+        mcnflag.IntFlag{
+            EnvVar: "SPEED_CLOUD_JOB_TIMEOUT",
+            Name:   "speedycloud-job-timeout",
+            Usage:  "Seconds to wait for SpeedyCloud to complete an operation such as starting, stopping or deleting the instance",
+            Value:  defaultJobTimeout,
+        },
+        mcnflag.IntFlag{
+            EnvVar: "SPEED_CLOUD_STOP_TIMEOUT",
+            Name:   "speedycloud-stop-timeout",
+            Usage:  "Seconds to wait for the instance to shut down on stop before powering it off",
+            Value:  defaultStopTimeout,
+        },
+        mcnflag.StringFlag{
+            EnvVar: "SPEED_CLOUD_RESTART_METHOD",
+            Name:   "speedycloud-restart-method",
+            Usage:  "How the instance is restarted: soft asks the guest to reboot, hard power cycles it",
+            Value:  defaultRestartMethod,
+        },
+        mcnflag.IntFlag{
+            EnvVar: "SPEED_CLOUD_API_RETRIES",
+            Name:   "speedycloud-api-retries",
+            Usage:  "number of times a failed SpeedyCloud API call is retried, 0 to disable",
+            Value:  defaultApiRetries,
+        },
         mcnflag.IntFlag{
             EnvVar: "SPEED_CLOUD_CPU_NUMBER",
             Name:   "speedycloud-cpu-number",
@@ -171,7 +292,7 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
         mcnflag.StringFlag{
             EnvVar: "SPEED_CLOUD_IMAGE_TYPE",
             Name:   "speedycloud-image-type",
-            Usage:  "imgage type of the instance",
+            Usage:  "image of the instance, or snapshot:<name or id> to boot from a snapshot",
             Value:  defaultImage,
         },
         mcnflag.StringFlag{
@@ -180,12 +301,52 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
             Usage:  "ip type of the instance, cloud be outer or inner",
             Value:  defaultIpType,
         },
+        mcnflag.StringFlag{
+            EnvVar: "SPEED_CLOUD_IP_CIDR",
+            Name:   "speedycloud-ip-cidr",
+            Usage:  "only use an address inside this CIDR, to choose among several addresses of the ip type",
+            Value:  "",
+        },
         mcnflag.StringFlag{
             EnvVar: "SPEED_CLOUD_GROUP_NAME",
             Name:   "speedycloud-group-name",
             Usage:  "the group of the instance",
             Value:  defaultGroupName,
         },
+        mcnflag.StringFlag{
+            EnvVar: "SPEED_CLOUD_SEC_GROUPS",
+            Name:   "speedycloud-sec-groups",
+            Usage:  "comma separated list of existing security groups the instance is placed in, besides " + defaultSecurityGroup,
+            Value:  "",
+        },
+        mcnflag.StringFlag{
+            EnvVar: "SPEED_CLOUD_VOLUMES",
+            Name:   "speedycloud-volumes",
+            Usage:  "comma separated list of data volumes to attach, each given as size or type:size in GB, e.g. SSD:100",
+            Value:  "",
+        },
+        mcnflag.BoolFlag{
+            EnvVar: "SPEED_CLOUD_DELETE_VOLUMES",
+            Name:   "speedycloud-delete-volumes",
+            Usage:  "delete the data volumes when the machine is removed instead of only detaching them",
+        },
+        mcnflag.StringFlag{
+            EnvVar: "SPEED_CLOUD_FLOATINGIP_POOL",
+            Name:   "speedycloud-floatingip-pool",
+            Usage:  "isp pool to allocate a floating IP from, an unattached address of the pool is reused if any",
+            Value:  "",
+        },
+        mcnflag.StringFlag{
+            EnvVar: "SPEED_CLOUD_FLOATINGIP",
+            Name:   "speedycloud-floatingip",
+            Usage:  "existing unattached floating IP address to associate with the instance",
+            Value:  "",
+        },
+        mcnflag.BoolFlag{
+            EnvVar: "SPEED_CLOUD_KEEP_ON_FAILURE",
+            Name:   "speedycloud-keep-on-failure",
+            Usage:  "keep the resources created so far when create fails, to debug failed boots",
+        },
     }
 }
 
@@ -197,6 +358,11 @@ func NewDerivedDriver(hostName, storePath string) *Driver {
     return &Driver{
         client:        &GenericClient{},
         ActiveTimeout: defaultActiveTimeout,
+        JobTimeout:    defaultJobTimeout,
+        StopTimeout:   defaultStopTimeout,
+        RestartMethod: defaultRestartMethod,
+        ApiRetries:    defaultApiRetries,
+        TokenTTL:      defaultTokenTTL,
         BaseDriver: &drivers.BaseDriver{
             SSHUser:     defaultSSHUser,
             SSHPort:     defaultSSHPort,
@@ -221,8 +387,18 @@ func (d *Driver) DriverName() string {
 
 func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
     d.SpeedCloudUrl = flags.String("speedycloud-url")
+    d.Insecure = flags.Bool("speedycloud-insecure")
+    d.CaCert = flags.String("speedycloud-cacert")
+    d.Proxy = flags.String("speedycloud-proxy")
     d.ApiKey = flags.String("speedycloud-api-key")
     d.ApiSecret = flags.String("speedycloud-api-secret")
+    d.Profile = flags.String("speedycloud-profile")
+    d.CredentialsFile = flags.String("speedycloud-credentials-file")
+    d.CredentialHelper = flags.String("speedycloud-credential-helper")
+    d.ApiToken = flags.String("speedycloud-api-token")
+    d.TokenAuth = flags.Bool("speedycloud-token-auth")
+    d.TokenTTL = flags.Int("speedycloud-token-ttl")
+    d.TokenScope = flags.String("speedycloud-token-scope")
     d.KeyPairName = flags.String("speedycloud-keypair-name")
     d.AvailabilityZone = flags.String("speedycloud-availability-zone")
     d.PrivateKeyFile = flags.String("speedycloud-private-key-file")
@@ -230,6 +406,10 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
     d.SSHUser = flags.String("speedycloud-ssh-user")
     d.SSHPort = flags.Int("speedycloud-ssh-port")
     d.ActiveTimeout = flags.Int("speedycloud-active-timeout")
+    d.JobTimeout = flags.Int("speedycloud-job-timeout")
+    d.StopTimeout = flags.Int("speedycloud-stop-timeout")
+    d.RestartMethod = flags.String("speedycloud-restart-method")
+    d.ApiRetries = flags.Int("speedycloud-api-retries")
     d.CpuNumber = flags.Int("speedycloud-cpu-number")
     d.Memory = flags.Int("speedycloud-memory")
     d.DiskType = flags.String("speedycloud-disk-type")
@@ -238,7 +418,14 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
     d.Bandwidth = flags.Int("speedycloud-bandwidth")
     d.ImageType = flags.String("speedycloud-image-type")
     d.IpType = flags.String("speedycloud-ip-type")
+    d.IpCidr = flags.String("speedycloud-ip-cidr")
     d.GroupName = flags.String("speedycloud-group-name")
+    d.KeepOnFailure = flags.Bool("speedycloud-keep-on-failure")
+    d.SecurityGroups = splitList(flags.String("speedycloud-sec-groups"))
+    d.Volumes = splitList(flags.String("speedycloud-volumes"))
+    d.DeleteVolumes = flags.Bool("speedycloud-delete-volumes")
+    d.FloatingIpPool = flags.String("speedycloud-floatingip-pool")
+    d.FloatingIp = flags.String("speedycloud-floatingip")
     if flags.String("speedycloud-user-data-file") != "" {
         userData, err := ioutil.ReadFile(flags.String("speedycloud-user-data-file"))
         if err == nil {
@@ -248,6 +435,22 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
         }
     }
 
+    source, err := d.credentialSource(d.ApiKey, d.ApiSecret)
+    if err != nil {
+        return err
+    }
+    d.CredentialSource = source
+    profile, err := loadProfile(d.CredentialsFile, d.Profile)
+    if err != nil {
+        return err
+    }
+    d.applyProfile(profile)
+    if d.CredentialSource == credentialSourceHelper {
+        if err := d.resolveCredentials(); err != nil {
+            return err
+        }
+    }
+
     d.SetSwarmConfigFromFlags(flags)
 
     return d.checkConfig()
@@ -266,7 +469,7 @@ func (d *Driver) GetURL() (string, error) {
         return "", nil
     }
 
-    return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, "2376")), nil
+    return fmt.Sprintf("tcp://%s", net.JoinHostPort(ip, strconv.Itoa(dockerPort))), nil
 }
 
 func (d *Driver) GetIP() (string, error) {
@@ -280,33 +483,98 @@ func (d *Driver) GetIP() (string, error) {
         return "", err
     }
 
-    // Looking for the IP address in a retry loop to deal with OpenStack latency
-    for retryCount := 0; retryCount < 200; retryCount++ {
+    if err := d.initNetwork(); err != nil {
+        return "", err
+    }
+
+    // Looking for the IP address in a poll loop to deal with SpeedyCloud latency
+    address := ""
+    err := d.newPoller(d.ActiveTimeout).Poll(context.Background(), func() (string, bool, error) {
         addresses, err := d.client.GetInstanceIPAddresses(d)
         if err != nil {
-            return "", err
+            return "", false, err
         }
-        if d.IpType == "inner" {
-            for _, a := range addresses {
-                if match, _:= regexp.MatchString(`192.*|172.*|10.*`, a); match{
-                    log.Debug("the address is %s", a)
-                    return a, nil
-                }
-            }
-        } else {
-            for _, a := range addresses {
-                if match, _:= regexp.MatchString(`192.*|172.*|10.*`, a); !match{
-                    log.Info("the address is %s", a)
-                    return a, nil
-                }
+        a := d.selectIPAddress(addresses)
+        if a == nil {
+            return "no " + d.IpType + " address", false, nil
+        }
+        log.Debug("IP address found", map[string]string{
+            "IP":      a.Address,
+            "Network": a.Network,
+        })
+        address = a.Address
+        return a.Address, true, nil
+    })
+    if _, ok := err.(*speedycloud.TimeoutError); ok {
+        return "", fmt.Errorf("No IP found for the machine")
+    }
+    return address, err
+}
 
-            }
+// privateNetworks are the RFC1918, carrier-grade NAT and IPv6 unique local
+// ranges. Addresses in them are "inner" addresses, any other one is "outer".
+var privateNetworks = mustParseCIDRs(
+    "10.0.0.0/8",
+    "172.16.0.0/12",
+    "192.168.0.0/16",
+    "100.64.0.0/10",
+    "fc00::/7",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+    nets := []*net.IPNet{}
+    for _, cidr := range cidrs {
+        _, n, err := net.ParseCIDR(cidr)
+        if err != nil {
+            panic(err)
         }
+        nets = append(nets, n)
+    }
+    return nets
+}
 
-        time.Sleep(2 * time.Second)
+func isPrivateIP(ip net.IP) bool {
+    for _, n := range privateNetworks {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
 
+// selectIPAddress picks the address the machine is reached on: the first one
+// of the requested type, inside --speedycloud-ip-cidr when it is set. IPv4
+// addresses are preferred unless the CIDR is an IPv6 one.
+func (d *Driver) selectIPAddress(addresses []IPAddress) *IPAddress {
+    var cidr *net.IPNet
+    if d.IpCidr != "" {
+        _, cidr, _ = net.ParseCIDR(d.IpCidr)
+    }
+    preferredVersion := 4
+    if cidr != nil && cidr.IP.To4() == nil {
+        preferredVersion = 6
     }
-    return "", fmt.Errorf("No IP found for the machine")
+
+    var fallback *IPAddress
+    for i, a := range addresses {
+        ip := net.ParseIP(a.Address)
+        if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+            continue
+        }
+        if isPrivateIP(ip) != (d.IpType == "inner") {
+            continue
+        }
+        if cidr != nil && !cidr.Contains(ip) {
+            continue
+        }
+        if a.Version == preferredVersion {
+            return &addresses[i]
+        }
+        if fallback == nil {
+            fallback = &addresses[i]
+        }
+    }
+    return fallback
 }
 
 func (d *Driver) GetState() (state.State, error) {
@@ -315,56 +583,276 @@ func (d *Driver) GetState() (state.State, error) {
         return state.None, err
     }
 
-    s, err := d.client.GetInstanceState(d)
+    status, hasRunningJob, err := d.client.GetInstanceState(d)
     if err != nil {
+        if speedycloud.IsNotFound(err) {
+            return state.None, ErrInstanceNotFound
+        }
         return state.None, err
     }
 
     log.Debug("State for OpenStack instance", map[string]string{
-        "MachineId": d.MachineId,
-        "State":     s,
+        "MachineId":     d.MachineId,
+        "State":         status,
+        "HasRunningJob": strconv.FormatBool(hasRunningJob),
     })
 
-    switch s {
-    case "Running":
+    s, err := instanceState(status)
+    if err != nil && err != ErrInstanceNotFound {
+        log.Warnf("SpeedyCloud instance %s: %s", d.MachineId, err)
+    }
+    return s, err
+}
+
+// instanceState maps the lifecycle status of a SpeedyCloud instance to a
+// machine state. The transitional statuses map to Starting or Stopping,
+// depending on whether the instance is usable once they complete. A settled
+// status is kept while a job runs on the instance: the job may as well attach
+// a volume or take a snapshot as start or stop the instance, and the API does
+// not say which.
+func instanceState(status string) (state.State, error) {
+    switch strings.ToLower(status) {
+    case "running":
         return state.Running, nil
-    case "Suspended":
-        return state.Saved, nil
-    case "Stopped":
+    case "stopped":
         return state.Stopped, nil
-    case "Provisioning":
+    case "suspended":
+        return state.Saved, nil
+    case "provisioning", "starting", "restarting", "resizing", "migrating":
         return state.Starting, nil
-    case "ERROR":
+    case "stopping", "deleting":
+        return state.Stopping, nil
+    case "deleted":
+        return state.None, ErrInstanceNotFound
+    case "error":
         return state.Error, nil
     }
-    return state.None, nil
+    return state.Error, fmt.Errorf(errorUnknownInstanceStatus, status)
 }
 
-func (d *Driver) Create() error {
+// PreCreateCheck validates the credentials and every resource the machine
+// depends on, so that nothing billable is created when one of them is wrong.
+func (d *Driver) PreCreateCheck() error {
+    if d.KeyPairName != "" {
+        if _, err := ioutil.ReadFile(d.PrivateKeyFile); err != nil {
+            return fmt.Errorf(errorUnreadablePrivateKey, d.PrivateKeyFile, err)
+        }
+    }
+
+    if err := d.initCompute(); err != nil {
+        return err
+    }
+
+    log.Debug("Checking credentials and availability zone...", map[string]string{"AZ": d.AvailabilityZone})
+    zones, err := d.client.GetAvailabilityZones(d)
+    if err != nil {
+        if speedycloud.IsAuthFailure(err) {
+            return fmt.Errorf(errorAuthentication, d.SpeedCloudUrl, err)
+        }
+        return err
+    }
+    if !containsString(zones, d.AvailabilityZone) {
+        return fmt.Errorf(errorUnknownAvailabilityZone, d.AvailabilityZone, strings.Join(zones, ", "))
+    }
+
     if err := d.resolveIds(); err != nil {
         return err
     }
+
+    if d.NetworkName != "" {
+        if err := d.initNetwork(); err != nil {
+            return err
+        }
+        log.Debug("Looking for the network...", map[string]string{"Name": d.NetworkName})
+        networkID, err := d.client.GetNetworkID(d)
+        if err != nil {
+            return err
+        }
+        if networkID == "" {
+            return fmt.Errorf(errorUnknownNetworkName, d.NetworkName)
+        }
+    }
+
+    for _, name := range d.SecurityGroups {
+        log.Debug("Looking for the security group...", map[string]string{"Name": name})
+        group, err := d.client.GetSecurityGroup(d, name)
+        if err != nil {
+            return err
+        }
+        if group == nil {
+            return fmt.Errorf(errorUnknownSecurityGroup, name)
+        }
+    }
+
+    if d.KeyPairName != "" {
+        log.Debug("Looking for the keypair...", map[string]string{"Name": d.KeyPairName})
+        keyPair, err := d.client.GetKeyPair(d, d.KeyPairName)
+        if err != nil && !speedycloud.IsNotFound(err) {
+            return fmt.Errorf(errorKeyPairLookup, d.KeyPairName, err)
+        }
+        if keyPair == nil {
+            return fmt.Errorf(errorUnknownKeyPairName, d.KeyPairName)
+        }
+    }
+
+    if d.FloatingIp != "" {
+        if err := d.initNetwork(); err != nil {
+            return err
+        }
+        log.Debug("Looking for the floating IP...", map[string]string{"IP": d.FloatingIp})
+        ips, err := d.client.GetFloatingIPs(d)
+        if err != nil {
+            return err
+        }
+        available := false
+        for _, ip := range ips {
+            if ip.Ip == d.FloatingIp && ip.MachineId == "" {
+                available = true
+                break
+            }
+        }
+        if !available {
+            return fmt.Errorf(errorUnavailableFloatingIP, d.FloatingIp)
+        }
+    }
+
+    return d.checkQuota()
+}
+
+func (d *Driver) checkQuota() error {
+    log.Debug("Checking quota...", map[string]string{"AZ": d.AvailabilityZone})
+    quota, err := d.client.GetQuota(d)
+    if err != nil {
+        return err
+    }
+
+    specs, err := parseVolumeSpecs(d.Volumes, d.DiskType)
+    if err != nil {
+        return err
+    }
+    volumesSize := 0
+    for _, spec := range specs {
+        volumesSize += spec.Size
+    }
+
+    checks := []struct {
+        resource    string
+        requested   int
+        used, limit int
+    }{
+        {"instance", 1, quota.UsedInstances, quota.MaxInstances},
+        {"cpu", d.CpuNumber, quota.UsedCpu, quota.MaxCpu},
+        {"memory", d.Memory, quota.UsedMemory, quota.MaxMemory},
+        {"disk", d.DiskCapacity + volumesSize, quota.UsedDisk, quota.MaxDisk},
+    }
+    for _, c := range checks {
+        if c.limit > 0 && c.used+c.requested > c.limit {
+            return fmt.Errorf(errorQuotaExceeded, c.resource, d.AvailabilityZone, c.requested, c.used, c.limit)
+        }
+    }
+    return nil
+}
+
+// undoStep tears down a resource created by Create.
+type undoStep struct {
+    resource string
+    undo     func() error
+}
+
+// rollback runs the undo steps in reverse order of creation. Failures are
+// logged rather than returned so that the error which aborted Create is the
+// one reported to the user.
+func (d *Driver) rollback(steps []undoStep) {
+    if d.KeepOnFailure {
+        log.Warn("Create failed, keeping the resources created so far as requested by --speedycloud-keep-on-failure")
+        return
+    }
+    for i := len(steps) - 1; i >= 0; i-- {
+        log.Infof("Create failed, removing %s...", steps[i].resource)
+        if err := steps[i].undo(); err != nil {
+            log.Warnf("Unable to remove %s: %s", steps[i].resource, err)
+        }
+    }
+}
+
+func (d *Driver) Create() (err error) {
+    var steps []undoStep
+    defer func() {
+        if err != nil {
+            d.rollback(steps)
+        }
+    }()
+
+    if err = d.resolveIds(); err != nil {
+        return err
+    }
     if d.KeyPairName != "" {
-        if err := d.loadSSHKey(); err != nil {
+        if err = d.loadSSHKey(); err != nil {
             return err
         }
     } else {
         d.KeyPairName = fmt.Sprintf("%s-%s", d.MachineName, mcnutils.GenerateRandomID())
-        if err := d.createSSHKey(); err != nil {
+        if err = d.createSSHKey(); err != nil {
             return err
         }
+        steps = append(steps, undoStep{"keypair " + d.KeyPairName, d.removeKeyPair})
+    }
+    createdGroupID, err := d.configureSecurityGroup()
+    if createdGroupID != "" {
+        steps = append(steps, undoStep{"security group " + defaultSecurityGroup, func() error {
+            return d.client.DeleteSecurityGroup(d, createdGroupID)
+        }})
     }
-    if err := d.createMachine(); err != nil {
+    if err != nil {
         return err
     }
-    if err := d.waitForInstanceActive(); err != nil {
+
+    if err = d.createMachine(); err != nil {
+        return err
+    }
+    steps = append(steps, undoStep{"instance " + d.MachineId, d.destroyInstance})
+
+    if err = d.waitForInstanceActive(); err != nil {
+        return err
+    }
+
+    specs, err := parseVolumeSpecs(d.Volumes, d.DiskType)
+    if err != nil {
         return err
     }
-    if err := d.lookForIPAddress(); err != nil {
+    for i, spec := range specs {
+        volumeID, err := d.createVolume(i, spec)
+        if volumeID != "" {
+            steps = append(steps, undoStep{"volume " + volumeID, func() error {
+                return d.removeVolume(volumeID, true)
+            }})
+        }
+        if err != nil {
+            return err
+        }
+    }
+    if d.usesFloatingIP() {
+        allocated, err := d.assignFloatingIP()
+        if d.FloatingIpId != "" {
+            floatingIpId := d.FloatingIpId
+            steps = append(steps, undoStep{"floating IP " + floatingIpId, func() error {
+                if err := d.client.DisassociateFloatingIP(d, floatingIpId); err != nil && !speedycloud.IsNotFound(err) {
+                    return err
+                }
+                if !allocated {
+                    return nil
+                }
+                return d.client.ReleaseFloatingIP(d, floatingIpId)
+            }})
+        }
+        if err != nil {
+            return err
+        }
+    } else if err = d.lookForIPAddress(); err != nil {
         return err
     }
 
-    if err := d.updateInstance(); err != nil {
+    if err = d.updateInstance(); err != nil {
         return err
     }
     return nil
@@ -375,28 +863,176 @@ func (d *Driver) Start() error {
         return err
     }
 
-    return d.client.StartInstance(d)
+    jobID, err := d.client.StartInstance(d)
+    if err != nil {
+        return err
+    }
+    return d.waitForJob(jobID, d.statusFallback("Running"))
 }
 
+// Stop asks the guest to shut down and waits for it, for at most the stop
+// timeout. An instance that is still running then is powered off.
 func (d *Driver) Stop() error {
     if err := d.initCompute(); err != nil {
         return err
     }
 
-    return d.client.StopInstance(d)
+    jobID, err := d.client.StopInstance(d)
+    if err != nil {
+        return err
+    }
+    if jobID != "" {
+        err = d.client.WaitForJob(d, jobID, d.StopTimeout)
+    } else {
+        err = d.client.WaitForInstanceStatus(d, "Stopped", d.StopTimeout)
+    }
+    if _, ok := err.(*speedycloud.TimeoutError); !ok {
+        return err
+    }
+    log.Warnf("SpeedyCloud instance %s did not shut down within %d seconds, powering it off", d.MachineId, d.StopTimeout)
+    return d.Kill()
 }
 
+// Restart reboots the instance the way --speedycloud-restart-method tells.
 func (d *Driver) Restart() error {
     if err := d.initCompute(); err != nil {
         return err
     }
 
-    return d.client.RestartInstance(d)
+    jobID, err := d.client.RestartInstance(d)
+    if err != nil {
+        return err
+    }
+    return d.waitForJob(jobID, d.statusFallback("Running"))
 }
 
+// Kill cuts the power of the instance, without letting the guest shut down.
 func (d *Driver) Kill() error {
+    if err := d.initCompute(); err != nil {
+        return err
+    }
+
+    jobID, err := d.client.PowerOffInstance(d)
+    if err != nil {
+        return err
+    }
+    return d.waitForJob(jobID, d.statusFallback("Stopped"))
+}
+
+// Resize changes the specification of the machine. Zero values keep the
+// current setting. The machine is stopped when CPU, memory or disk change,
+// and started again afterwards if it was running. The driver configuration is
+// updated once the new specification is applied.
+func (d *Driver) Resize(cpu, memory, bandwidth, disk int) error {
+    if disk > 0 && disk < d.DiskCapacity {
+        return fmt.Errorf(errorDiskShrink, d.DiskCapacity, disk)
+    }
+    if err := d.initCompute(); err != nil {
+        return err
+    }
+
+    log.Debug("Resizing SpeedyCloud instance...", map[string]string{
+        "MachineId":    d.MachineId,
+        "Cpu":          strconv.Itoa(cpu),
+        "Memory":       strconv.Itoa(memory),
+        "Bandwidth":    strconv.Itoa(bandwidth),
+        "DiskCapacity": strconv.Itoa(disk),
+    })
+
+    current, err := d.GetState()
+    if err != nil {
+        return err
+    }
+    needsStop := cpu > 0 || memory > 0 || disk > 0
+    if needsStop && current != state.Stopped {
+        log.Info("Stopping the instance to resize it...")
+        if err := d.Stop(); err != nil {
+            return err
+        }
+    }
+
+    jobID, err := d.client.ResizeInstance(d, cpu, memory, bandwidth, disk)
+    if err != nil {
+        return err
+    }
+    if err := d.waitForJob(jobID, func() error {
+        if needsStop {
+            return d.statusFallback("Stopped")()
+        }
+        return nil
+    }); err != nil {
+        return err
+    }
+
+    if needsStop && current == state.Running {
+        log.Info("Starting the resized instance...")
+        if err := d.Start(); err != nil {
+            return err
+        }
+    }
+
+    if cpu > 0 {
+        d.CpuNumber = cpu
+    }
+    if memory > 0 {
+        d.Memory = memory
+    }
+    if bandwidth > 0 {
+        d.Bandwidth = bandwidth
+    }
+    if disk > 0 {
+        d.DiskCapacity = disk
+    }
+    return nil
+}
+
+// CreateSnapshot captures the system disk of the machine and waits until the
+// snapshot is available. The returned ID can be passed to another machine as
+// --speedycloud-image-type snapshot:<id>.
+func (d *Driver) CreateSnapshot(name string) (string, error) {
+    if err := d.initCompute(); err != nil {
+        return "", err
+    }
+
+    log.Info("Creating snapshot...")
+    log.Debug("Creating snapshot...", map[string]string{
+        "MachineId": d.MachineId,
+        "Name":      name,
+    })
+    snapshotID, err := d.client.CreateSnapshot(d, name)
+    if err != nil {
+        return "", err
+    }
+    if err := d.client.WaitForSnapshotStatus(d, snapshotID, snapshots.StatusAvailable); err != nil {
+        return snapshotID, err
+    }
+    return snapshotID, nil
+}
 
-    return d.Stop()
+// RestoreSnapshot rolls the system disk of a stopped machine back to one of
+// its snapshots.
+func (d *Driver) RestoreSnapshot(snapshotID string) error {
+    if err := d.initCompute(); err != nil {
+        return err
+    }
+
+    current, err := d.GetState()
+    if err != nil {
+        return err
+    }
+    if current != state.Stopped {
+        return fmt.Errorf(errorSnapshotRequiresStop, current)
+    }
+
+    log.Info("Restoring snapshot...")
+    log.Debug("Restoring snapshot...", map[string]string{
+        "MachineId":  d.MachineId,
+        "SnapshotId": snapshotID,
+    })
+    if err := d.client.RestoreSnapshot(d, snapshotID); err != nil {
+        return err
+    }
+    return d.client.WaitForSnapshotStatus(d, snapshotID, snapshots.StatusAvailable)
 }
 
 func (d *Driver) Remove() error {
@@ -405,21 +1041,110 @@ func (d *Driver) Remove() error {
     if err := d.initCompute(); err != nil {
         return err
     }
-    if status, _ := d.GetState(); status != state.Stopped {
-        d.Stop()
-        d.waitForInstanceStopped()
+    for _, volumeID := range d.VolumeIds {
+        if err := d.removeVolume(volumeID, false); err != nil {
+            return err
+        }
     }
-    if err := d.client.DeleteInstance(d); err != nil {
+    if d.FloatingIpId != "" {
+        if err := d.initNetwork(); err != nil {
+            return err
+        }
+        log.Debug("disassociating floating IP...", map[string]string{"FloatingIpId": d.FloatingIpId})
+        if err := d.client.DisassociateFloatingIP(d, d.FloatingIpId); err != nil && !speedycloud.IsNotFound(err) {
+            return err
+        }
+    }
+    if err := d.destroyInstance(); err != nil {
+        return err
+    }
+    if d.DeleteVolumes {
+        for _, volumeID := range d.VolumeIds {
+            log.Debug("deleting volume...", map[string]string{"VolumeId": volumeID})
+            if err := d.client.DeleteVolume(d, volumeID); err != nil && !speedycloud.IsNotFound(err) {
+                return err
+            }
+        }
+        d.VolumeIds = nil
+    }
+    if err := d.removeKeyPair(); err != nil {
         return err
     }
-    //log.Debug("deleting key pair...", map[string]string{"Name": d.KeyPairName})
-    // TODO (fsoppelsa) maybe we want to check this, in case of shared keypairs, before removal
-    //if err := d.client.DeleteKeyPair(d, d.KeyPairName); err != nil {
-    //	return err
-    //}
     return nil
 }
 
+// removeKeyPair deletes the keypair the driver generated for the machine,
+// unless another instance still uses it. Keypairs supplied by the user, and
+// generated ones that lost the tag of the driver, are never deleted.
+func (d *Driver) removeKeyPair() error {
+    if !d.KeyPairGenerated {
+        log.Debug("Keeping user supplied keypair", map[string]string{"Name": d.KeyPairName})
+        return nil
+    }
+    keyPair, err := d.client.GetKeyPair(d, d.KeyPairName)
+    if err != nil {
+        return err
+    }
+    if keyPair == nil {
+        log.Debug("Keypair already deleted", map[string]string{"Name": d.KeyPairName})
+        return nil
+    }
+    if !strings.HasSuffix(strings.TrimSpace(keyPair.PublicKey), " "+generatedKeyPairTag) {
+        log.Warnf("Keeping keypair %s, it is no longer tagged %s", d.KeyPairName, generatedKeyPairTag)
+        return nil
+    }
+    users := []string{}
+    for _, serverID := range keyPair.Servers {
+        if serverID != d.MachineId {
+            users = append(users, serverID)
+        }
+    }
+    if len(users) > 0 {
+        log.Warnf("Keeping keypair %s, it is still used by instances %s", d.KeyPairName, strings.Join(users, ", "))
+        return nil
+    }
+
+    log.Debug("deleting key pair...", map[string]string{"Name": d.KeyPairName, "KeyPairId": keyPair.ID})
+    if err := d.client.DeleteKeyPair(d, keyPair.ID); err != nil && !speedycloud.IsNotFound(err) {
+        return err
+    }
+    return nil
+}
+
+// destroyInstance stops the instance if it is running, deletes it and waits
+// until it is gone.
+func (d *Driver) destroyInstance() error {
+    if err := d.initCompute(); err != nil {
+        return err
+    }
+    status, err := d.GetState()
+    if err == ErrInstanceNotFound {
+        log.Debug("Instance already deleted", map[string]string{"MachineId": d.MachineId})
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if status == state.Running {
+        if err := d.Stop(); err != nil {
+            return err
+        }
+    }
+    jobID, err := d.client.DeleteInstance(d)
+    if err != nil {
+        if speedycloud.IsNotFound(err) {
+            return nil
+        }
+        return err
+    }
+    return d.waitForJob(jobID, d.waitForInstanceDeleted)
+}
+
+// ErrInstanceNotFound is returned by GetState when the instance of the machine
+// no longer exists on SpeedyCloud, for instance because it was deleted from
+// the console.
+var ErrInstanceNotFound = errors.New("SpeedyCloud instance not found")
+
 const (
     errorMandatoryEnvOrOption string = "%s must be specified either using the environment variable %s or the CLI option %s"
     //errorMandatoryOption string = "%s must be specified using the CLI option %s"
@@ -428,8 +1153,39 @@ const (
     //errorMandatoryTenantNameOrID string = "Tenant id or name must be provided either using one of the environment variables OS_TENANT_ID and OS_TENANT_NAME or one of the CLI options --speedycloud-tenant-id and --speedycloud-tenant-name"
     //errorWrongEndpointType string = "Endpoint type must be 'publicURL', 'adminURL' or 'internalURL'"
     //errorUnknownFlavorName string = "Unable to find flavor named %s"
-    //errorUnknownImageName string = "Unable to find image named %s"
-    //errorUnknownNetworkName string = "Unable to find network named %s"
+    errorUnknownImageName string = "Unable to find image named %s in availability zone %s"
+    errorUnknownImageNameSuggest string = "Unable to find image named %s in availability zone %s, did you mean: %s?"
+    errorUnknownSnapshot string = "Unable to find an available snapshot %s in availability zone %s"
+    errorAmbiguousSnapshot string = "Several snapshots are named %s, use the snapshot id instead"
+    errorUnknownInstanceStatus string = "Unknown SpeedyCloud instance status %q"
+    errorSnapshotRequiresStop string = "The machine must be stopped to restore a snapshot, its state is %s"
+    errorUnknownNetworkName string = "Unable to find network named %s"
+    errorUnknownAvailabilityZone string = "Unable to find availability zone %s, available zones are: %s"
+    errorUnknownKeyPairName string = "Unable to find keypair named %s"
+    errorKeyPairLookup string = "Unable to look up keypair named %s: %v"
+    errorUnknownSecurityGroup string = "Unable to find security group named %s"
+    errorUnavailableFloatingIP string = "Floating IP %s does not exist or is already associated with another instance"
+    errorMandatoryCredential string = "%s must be specified either in the credentials file as %s, using the environment variable %s or the CLI option %s"
+    errorMixedCredentials string = "The api key and the api secret must both be given as flags or environment variables, or both be read from the credentials file"
+    errorUnresolvedCredentials string = "Unable to resolve the api key and secret of the machine from its %s credential source"
+    errorCredentialHelper string = "Credential helper %q failed: %s"
+    errorCredentialsFile string = "Unable to load credentials file %s: %s"
+    errorUnknownProfile string = "Profile %s not found in %s"
+    errorInvalidURL string = "Invalid %s %q, expected an absolute URL"
+    errorInvalidCaCert string = "Unable to load the CA certificates of %s: %s"
+    errorInvalidApiRetries string = "Invalid api retries %d, expected 0 or more"
+    errorInvalidTokenTTL string = "Invalid token ttl %d, expected 0 or more seconds"
+    errorInvalidJobTimeout string = "Invalid job timeout %d, expected 1 or more seconds"
+    errorInvalidStopTimeout string = "Invalid stop timeout %d, expected 1 or more seconds"
+    errorInvalidRestartMethod string = "Invalid restart method %q, expected soft or hard"
+    errorInvalidIpType string = "Invalid ip type %q, expected inner or outer"
+    errorInvalidIpCidr string = "Invalid ip cidr %q: %s"
+    errorDiskShrink string = "The system disk can only grow, from %dGB to %dGB requested"
+    errorInvalidVolume string = "Invalid volume %q, expected size or type:size in GB"
+    errorUnreadablePrivateKey string = "Unable to read private key file %s: %s"
+    errorAuthentication string = "Unable to authenticate against %s, check the api key and secret: %s"
+    errorQuotaExceeded string = "Not enough %s quota left in availability zone %s: %d requested, %d of %d already used"
+    errorQuotaRejected string = "SpeedyCloud refused to create the instance in availability zone %s, a quota is exceeded: %s"
     //errorUnknownTenantName string = "Unable to find tenant named %s"
 )
 
@@ -438,12 +1194,26 @@ func (d *Driver) checkConfig() error {
     if d.SpeedCloudUrl == "" {
         return fmt.Errorf(errorMandatoryEnvOrOption, "Speedycloud url", "SPEED_CLOUD_URL", "--speedycloud-url")
     }
+    apiURL, err := url.Parse(d.SpeedCloudUrl)
+    if err != nil || (apiURL.Scheme != "https" && apiURL.Scheme != "http") {
+        return fmt.Errorf(errorInvalidURL, "Speedycloud url", d.SpeedCloudUrl)
+    }
+    if apiURL.Scheme == "http" {
+        log.Warnf("%s is not using https, API requests and boot scripts are sent unencrypted", d.SpeedCloudUrl)
+    }
+    if d.Proxy != "" {
+        if proxyURL, err := url.Parse(d.Proxy); err != nil || proxyURL.Host == "" {
+            return fmt.Errorf(errorInvalidURL, "Proxy", d.Proxy)
+        }
+    }
 
-    if d.ApiKey == "" {
-        return fmt.Errorf(errorMandatoryEnvOrOption, "Api key", "SPEED_CLOUD_API_KEY", "speedycloud-api-key")
+    // A static api token replaces the api key and secret.
+    staticToken := d.ApiToken != "" && !d.TokenAuth
+    if d.ApiKey == "" && !staticToken {
+        return fmt.Errorf(errorMandatoryCredential, "Api key", "api_key", apiKeyEnvVar, "speedycloud-api-key")
     }
-    if d.ApiSecret == "" {
-        return fmt.Errorf(errorMandatoryEnvOrOption, "Api secret", "SPEED_CLOUD_API_SECRET", "speedycloud-api-secret")
+    if d.ApiSecret == "" && !staticToken {
+        return fmt.Errorf(errorMandatoryCredential, "Api secret", "api_secret", apiSecretEnvVar, "speedycloud-api-secret")
     }
     //if d.KeyPairName == "" {
     //    return fmt.Errorf(errorMandatoryEnvOrOption, "Key Pair Name", "SPEED_CLOUD_KEYPAIR_NAME", "speedycloud-keypair-name")
@@ -454,31 +1224,111 @@ func (d *Driver) checkConfig() error {
     //if d.PrivateKeyFile == "" {
     //    return fmt.Errorf(errorMandatoryEnvOrOption, "Private Key File", "SPEED_CLOUD_PRIVATE_KEY_FILE", "speedycloud-private-key-file")
     //}
+    if d.ApiRetries < 0 {
+        return fmt.Errorf(errorInvalidApiRetries, d.ApiRetries)
+    }
+    if d.TokenTTL < 0 {
+        return fmt.Errorf(errorInvalidTokenTTL, d.TokenTTL)
+    }
+    if d.JobTimeout <= 0 {
+        return fmt.Errorf(errorInvalidJobTimeout, d.JobTimeout)
+    }
+    if d.StopTimeout <= 0 {
+        return fmt.Errorf(errorInvalidStopTimeout, d.StopTimeout)
+    }
+    if d.RestartMethod != "soft" && d.RestartMethod != "hard" {
+        return fmt.Errorf(errorInvalidRestartMethod, d.RestartMethod)
+    }
     if d.SSHUser == "" {
         return fmt.Errorf(errorMandatoryEnvOrOption, "Ssh User ", "SPEED_CLOUD_SSH_USER", "speedycloud-ssh-user")
     }
-    if string(d.SSHPort) == "" {
+    if d.SSHPort <= 0 {
         return fmt.Errorf(errorMandatoryEnvOrOption, "Ssh Port", "SPEED_CLOUD_SSH_PORT", "speedycloud-ssh-port")
     }
-    if string(d.CpuNumber) == "" {
+    if d.CpuNumber <= 0 {
         return fmt.Errorf(errorMandatoryEnvOrOption, "Cpu Number", "SPEED_CLOUD_CPU_NUMBER", "speedycloud-cpu-number")
     }
-    if string(d.Memory) == "" {
+    if d.Memory <= 0 {
         return fmt.Errorf(errorMandatoryEnvOrOption, "Memory", "SPEED_CLOUD_MEMORY", "speedycloud-memory")
     }
-    if d.ImageType == "" {
-        return fmt.Errorf(errorMandatoryEnvOrOption, "Key Pair Name", "SPEED_CLOUD_IMAGE_TYPE", "speedycloud-image-type")
+    if ref, isSnapshot := snapshotReference(d.ImageType); d.ImageType == "" || (isSnapshot && ref == "") {
+        return fmt.Errorf(errorMandatoryEnvOrOption, "Image Type", "SPEED_CLOUD_IMAGE_TYPE", "speedycloud-image-type")
+    }
+    if _, err := parseVolumeSpecs(d.Volumes, d.DiskType); err != nil {
+        return err
+    }
+    if d.IpType != "inner" && d.IpType != "outer" {
+        return fmt.Errorf(errorInvalidIpType, d.IpType)
+    }
+    if d.IpCidr != "" {
+        if _, _, err := net.ParseCIDR(d.IpCidr); err != nil {
+            return fmt.Errorf(errorInvalidIpCidr, d.IpCidr, err)
+        }
     }
 
     return nil
 }
 
 func (d *Driver) resolveIds() error {
+    if err := d.initCompute(); err != nil {
+        return err
+    }
+
+    if ref, ok := snapshotReference(d.ImageType); ok {
+        return d.resolveSnapshot(ref)
+    }
 
+    log.Debug("Looking for the image...", map[string]string{
+        "Image": d.ImageType,
+        "AZ":    d.AvailabilityZone,
+    })
+    names, err := d.client.GetImageNames(d)
+    if err != nil {
+        return err
+    }
+
+    imageName, suggestions := matchImageName(d.ImageType, names)
+    if imageName == "" {
+        if len(suggestions) > 0 {
+            return fmt.Errorf(errorUnknownImageNameSuggest, d.ImageType, d.AvailabilityZone, strings.Join(suggestions, ", "))
+        }
+        return fmt.Errorf(errorUnknownImageName, d.ImageType, d.AvailabilityZone)
+    }
+    if imageName != d.ImageType {
+        log.Debug("Image name resolved", map[string]string{"From": d.ImageType, "To": imageName})
+        d.ImageType = imageName
+    }
+    return nil
+}
+
+// resolveSnapshot looks up the snapshot the instance is booted from and
+// records its ID.
+func (d *Driver) resolveSnapshot(ref string) error {
+    log.Debug("Looking for the snapshot...", map[string]string{
+        "Snapshot": ref,
+        "AZ":       d.AvailabilityZone,
+    })
+    list, err := d.client.GetSnapshots(d)
+    if err != nil {
+        return err
+    }
+
+    snapshot, err := matchSnapshot(ref, list)
+    if err != nil {
+        return err
+    }
+    if snapshot == nil || snapshot.Status != snapshots.StatusAvailable {
+        return fmt.Errorf(errorUnknownSnapshot, ref, d.AvailabilityZone)
+    }
+    log.Debug("Found snapshot", map[string]string{"Snapshot": ref, "SnapshotId": snapshot.ID})
+    d.SnapshotId = snapshot.ID
     return nil
 }
 
 func (d *Driver) initCompute() error {
+    if err := d.resolveCredentials(); err != nil {
+        return err
+    }
     if err := d.client.InitProviderClient(d); err != nil {
         return err
     }
@@ -489,6 +1339,9 @@ func (d *Driver) initCompute() error {
 }
 
 func (d *Driver) initNetwork() error {
+    if err := d.resolveCredentials(); err != nil {
+        return err
+    }
     if err := d.client.InitProviderClient(d); err != nil {
         return err
     }
@@ -536,17 +1389,21 @@ func (d *Driver) createSSHKey() error {
     if err := d.initCompute(); err != nil {
         return err
     }
-    if err := d.client.CreateKeyPair(d, d.KeyPairName, string(publicKey)); err != nil {
+    // The comment of the uploaded key tags the keypair as generated by the
+    // driver, so that Remove can tell it from the keypairs of the user.
+    taggedKey := strings.TrimSpace(string(publicKey)) + " " + generatedKeyPairTag
+    if err := d.client.CreateKeyPair(d, d.KeyPairName, taggedKey); err != nil {
         return err
     }
+    d.KeyPairGenerated = true
     return nil
 }
 
 func (d *Driver) createMachine() error {
     log.Debug("Creating SpeedyCloud instance...", map[string]string{
-        "Cpu": string(d.CpuNumber),
-        "Memory": string(d.Memory),
-        "diskCapacity": string(d.DiskCapacity),
+        "Cpu": strconv.Itoa(d.CpuNumber),
+        "Memory": strconv.Itoa(d.Memory),
+        "diskCapacity": strconv.Itoa(d.DiskCapacity),
         "ImageId":  d.ImageType,
     })
 
@@ -555,65 +1412,228 @@ func (d *Driver) createMachine() error {
     }
     instanceID, err := d.client.CreateInstance(d)
     if err != nil {
+        if speedycloud.IsQuotaExceeded(err) {
+            return fmt.Errorf(errorQuotaRejected, d.AvailabilityZone, err)
+        }
         return err
     }
     d.MachineId = instanceID
     return nil
 }
 
-//func (d *Driver) assignFloatingIP() error {
-//    var err error
-//
-//    if d.ComputeNetwork {
-//        err = d.initCompute()
-//    } else {
-//        err = d.initNetwork()
-//    }
-//
-//    if err != nil {
-//        return err
-//    }
-//
-//    ips, err := d.client.GetFloatingIPs(d)
-//    if err != nil {
-//        return err
-//    }
-//
-//    var floatingIP *FloatingIP
-//
-//    log.Debugf("Looking for an available floating IP", map[string]string{
-//        "MachineId": d.MachineId,
-//        "Pool":      d.FloatingIpPool,
-//    })
-//
-//    for _, ip := range ips {
-//        if ip.PortId == "" {
-//            log.Debug("Available floating IP found", map[string]string{
-//                "MachineId": d.MachineId,
-//                "IP":        ip.Ip,
-//            })
-//            floatingIP = &ip
-//            break
-//        }
-//    }
-//
-//    if floatingIP == nil {
-//        floatingIP = &FloatingIP{}
-//        log.Debug("No available floating IP found. Allocating a new one...", map[string]string{"MachineId": d.MachineId})
-//    } else {
-//        log.Debug("Assigning floating IP to the instance", map[string]string{"MachineId": d.MachineId})
-//    }
-//
-//    if err := d.client.AssignFloatingIP(d, floatingIP); err != nil {
-//        return err
-//    }
-//    d.IPAddress = floatingIP.Ip
-//    return nil
-//}
+func (d *Driver) usesFloatingIP() bool {
+    return d.FloatingIpPool != "" || d.FloatingIp != ""
+}
+
+// assignFloatingIP associates a floating IP with the instance, reusing an
+// unattached address of the pool when one exists. It returns whether a new
+// address had to be allocated.
+func (d *Driver) assignFloatingIP() (bool, error) {
+    if err := d.initNetwork(); err != nil {
+        return false, err
+    }
+
+    ips, err := d.client.GetFloatingIPs(d)
+    if err != nil {
+        return false, err
+    }
+
+    var floatingIP *FloatingIP
+
+    log.Debug("Looking for an available floating IP", map[string]string{
+        "MachineId": d.MachineId,
+        "Pool":      d.FloatingIpPool,
+        "IP":        d.FloatingIp,
+    })
+
+    for i, ip := range ips {
+        if d.FloatingIp != "" && ip.Ip != d.FloatingIp {
+            continue
+        }
+        if ip.MachineId == "" {
+            log.Debug("Available floating IP found", map[string]string{
+                "MachineId": d.MachineId,
+                "IP":        ip.Ip,
+            })
+            floatingIP = &ips[i]
+            break
+        }
+    }
+
+    if floatingIP == nil {
+        if d.FloatingIp != "" {
+            return false, fmt.Errorf(errorUnavailableFloatingIP, d.FloatingIp)
+        }
+        floatingIP = &FloatingIP{}
+        log.Debug("No available floating IP found. Allocating a new one...", map[string]string{"MachineId": d.MachineId})
+    } else {
+        log.Debug("Assigning floating IP to the instance", map[string]string{"MachineId": d.MachineId})
+    }
+
+    allocated := floatingIP.Id == ""
+    err = d.client.AssignFloatingIP(d, floatingIP)
+    d.FloatingIpId = floatingIP.Id
+    if err != nil {
+        return allocated, err
+    }
+    d.IPAddress = floatingIP.Ip
+    return allocated, nil
+}
+
+// configureSecurityGroup makes sure the docker-machine security group exists
+// and opens the SSH, Docker and Swarm master ports. It returns the ID of the
+// group when it had to be created.
+func (d *Driver) configureSecurityGroup() (string, error) {
+    log.Debug("Configuring security group...", map[string]string{"Name": defaultSecurityGroup})
+    group, err := d.client.GetSecurityGroup(d, defaultSecurityGroup)
+    if err != nil {
+        return "", err
+    }
+
+    createdID := ""
+    if group == nil {
+        log.Infof("Creating security group %s...", defaultSecurityGroup)
+        group, err = d.client.CreateSecurityGroup(d, defaultSecurityGroup)
+        if err != nil {
+            return "", err
+        }
+        createdID = group.ID
+    }
+
+    ports := []int{d.SSHPort, dockerPort}
+    if d.SwarmMaster {
+        port, err := d.swarmMasterPort()
+        if err != nil {
+            return createdID, err
+        }
+        ports = append(ports, port)
+    }
+
+    for _, port := range ports {
+        allowed := false
+        for _, rule := range group.Rules {
+            if rule.Allows("tcp", port) {
+                allowed = true
+                break
+            }
+        }
+        if allowed {
+            continue
+        }
+        log.Debug("Opening port in security group", map[string]string{
+            "Name": defaultSecurityGroup,
+            "Port": strconv.Itoa(port),
+        })
+        if err := d.client.AddSecurityGroupRule(d, group.ID, port); err != nil {
+            return createdID, err
+        }
+    }
+    return createdID, nil
+}
+
+func (d *Driver) swarmMasterPort() (int, error) {
+    if d.SwarmHost == "" {
+        return swarmPort, nil
+    }
+    u, err := url.Parse(d.SwarmHost)
+    if err != nil {
+        return 0, err
+    }
+    _, port, err := net.SplitHostPort(u.Host)
+    if err != nil {
+        return 0, err
+    }
+    return strconv.Atoi(port)
+}
+
+// securityGroupNames returns the security groups the instance is placed in.
+func (d *Driver) securityGroupNames() []string {
+    names := []string{defaultSecurityGroup}
+    for _, name := range d.SecurityGroups {
+        if !containsString(names, name) {
+            names = append(names, name)
+        }
+    }
+    return names
+}
+
+// volumeSpec describes a data volume requested with --speedycloud-volumes.
+type volumeSpec struct {
+    Type string
+    Size int
+}
+
+func parseVolumeSpecs(values []string, defaultType string) ([]volumeSpec, error) {
+    specs := []volumeSpec{}
+    for _, value := range values {
+        spec := volumeSpec{Type: defaultType}
+        size := value
+        if i := strings.LastIndex(value, ":"); i >= 0 {
+            spec.Type = strings.TrimSpace(value[:i])
+            size = value[i+1:]
+        }
+        n, err := strconv.Atoi(strings.TrimSpace(size))
+        if err != nil || n <= 0 || spec.Type == "" {
+            return nil, fmt.Errorf(errorInvalidVolume, value)
+        }
+        spec.Size = n
+        specs = append(specs, spec)
+    }
+    return specs, nil
+}
+
+// createVolume provisions a data volume and attaches it to the instance. The
+// ID of the volume is returned as soon as it exists, even on error, so that
+// it can be cleaned up.
+func (d *Driver) createVolume(index int, spec volumeSpec) (string, error) {
+    name := fmt.Sprintf("%s-data-%d", d.MachineName, index+1)
+    log.Infof("Creating volume %s (%s, %dGB)...", name, spec.Type, spec.Size)
+    volumeID, err := d.client.CreateVolume(d, name, spec.Type, spec.Size)
+    if err != nil {
+        return "", err
+    }
+    if err := d.client.WaitForVolumeStatus(d, volumeID, volumes.StatusAvailable); err != nil {
+        return volumeID, err
+    }
+
+    log.Debug("Attaching volume...", map[string]string{
+        "VolumeId":  volumeID,
+        "MachineId": d.MachineId,
+    })
+    if err := d.client.AttachVolume(d, volumeID); err != nil {
+        return volumeID, err
+    }
+    if err := d.client.WaitForVolumeStatus(d, volumeID, volumes.StatusInUse); err != nil {
+        return volumeID, err
+    }
+    d.VolumeIds = append(d.VolumeIds, volumeID)
+    return volumeID, nil
+}
+
+// removeVolume detaches a volume from the instance and, if requested, deletes it.
+func (d *Driver) removeVolume(volumeID string, remove bool) error {
+    log.Debug("Detaching volume...", map[string]string{
+        "VolumeId":  volumeID,
+        "MachineId": d.MachineId,
+    })
+    if err := d.client.DetachVolume(d, volumeID); err != nil {
+        if speedycloud.IsNotFound(err) {
+            return nil
+        }
+        return err
+    }
+    if err := d.client.WaitForVolumeStatus(d, volumeID, volumes.StatusAvailable); err != nil {
+        return err
+    }
+    if remove {
+        return d.client.DeleteVolume(d, volumeID)
+    }
+    return nil
+}
 
 func (d *Driver) waitForInstanceActive() error {
     log.Debug("Waiting for the SpeedyCloud instance to be running...", map[string]string{"MachineId": d.MachineId})
-    if err := d.client.WaitForInstanceStatus(d, "Running"); err != nil {
+    if err := d.client.WaitForInstanceStatus(d, "Running", d.ActiveTimeout); err != nil {
         return err
     }
     return nil
@@ -630,12 +1650,59 @@ func (d *Driver) updateInstance() error {
     return nil
 }
 
-func (d *Driver) waitForInstanceStopped() error {
-    log.Debug("Waiting for the SpeedyCloud instance to be stopped...", map[string]string{"MachineId": d.MachineId})
-    if err := d.client.WaitForInstanceStatus(d, "Stopped"); err != nil {
-        return err
+// waitForInstanceDeleted polls the instance until SpeedyCloud no longer knows
+// it, for at most the job timeout. Any other error getting its state stops
+// the wait.
+func (d *Driver) waitForInstanceDeleted() error {
+    log.Debug("Waiting for the SpeedyCloud instance to be deleted...", map[string]string{"MachineId": d.MachineId})
+    return d.newPoller(d.JobTimeout).Poll(context.Background(), func() (string, bool, error) {
+        s, err := d.GetState()
+        if err == ErrInstanceNotFound {
+            return "deleted", true, nil
+        }
+        if err != nil {
+            return "", false, err
+        }
+        return s.String(), false, nil
+    })
+}
+
+// newPoller returns a poller giving up after timeout seconds, that reports
+// the progress of the wait to the debug log.
+func (d *Driver) newPoller(timeout int) *speedycloud.Poller {
+    poller := speedycloud.NewWaitPoller(timeout)
+    poller.Progress = func(p speedycloud.PollProgress) {
+        log.Debug("Still waiting for SpeedyCloud...", map[string]string{
+            "MachineId": d.MachineId,
+            "Status":    p.Status,
+            "Attempt":   strconv.Itoa(p.Attempt),
+            "Elapsed":   p.Elapsed.String(),
+        })
+    }
+    return poller
+}
+
+// waitForJob blocks until the job carrying out an operation on the instance
+// completes, and reports why it failed if it did. When the API did not report
+// a job, fallback waits for the instance to reach the status the operation
+// leads to instead.
+func (d *Driver) waitForJob(jobID string, fallback func() error) error {
+    if jobID == "" {
+        return fallback()
+    }
+    log.Debug("Waiting for the SpeedyCloud job to complete...", map[string]string{
+        "MachineId": d.MachineId,
+        "JobId":     jobID,
+    })
+    return d.client.WaitForJob(d, jobID, d.JobTimeout)
+}
+
+// statusFallback returns a fallback for waitForJob that waits for the instance
+// to reach status, for at most the job timeout like the job it stands for.
+func (d *Driver) statusFallback(status string) func() error {
+    return func() error {
+        return d.client.WaitForInstanceStatus(d, status, d.JobTimeout)
     }
-    return nil
 }
 
 func (d *Driver) lookForIPAddress() error {
@@ -659,6 +1726,141 @@ func (d *Driver) publicSSHKeyPath() string {
     return d.GetSSHKeyPath() + ".pub"
 }
 
+// splitList splits a comma separated option value, dropping blank items.
+func splitList(value string) []string {
+    items := []string{}
+    for _, item := range strings.Split(value, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
 func sanitizeKeyPairName(s *string) {
     *s = strings.Replace(*s, ".", "_", -1)
 }
+
+// snapshotReference reports whether an image type refers to a snapshot and
+// returns the snapshot name or ID.
+func snapshotReference(imageType string) (string, bool) {
+    if !strings.HasPrefix(imageType, snapshotImagePrefix) {
+        return "", false
+    }
+    return strings.TrimSpace(strings.TrimPrefix(imageType, snapshotImagePrefix)), true
+}
+
+// matchSnapshot finds the snapshot whose ID, or otherwise unique name, is ref.
+// It returns nil when nothing matches.
+func matchSnapshot(ref string, available []snapshots.Snapshot) (*snapshots.Snapshot, error) {
+    var named []snapshots.Snapshot
+    for i := range available {
+        if available[i].ID == ref {
+            return &available[i], nil
+        }
+        if available[i].Name == ref {
+            named = append(named, available[i])
+        }
+    }
+    switch len(named) {
+    case 0:
+        return nil, nil
+    case 1:
+        return &named[0], nil
+    }
+    return nil, fmt.Errorf(errorAmbiguousSnapshot, ref)
+}
+
+const maxImageSuggestions = 5
+
+// matchImageName looks name up in the available image names. An exact match wins, otherwise a
+// single match ignoring case and blanks is accepted. When nothing matches, the closest names
+// are returned as suggestions.
+func matchImageName(name string, available []string) (string, []string) {
+    normalize := func(s string) string {
+        return strings.ToLower(strings.Join(strings.Fields(s), ""))
+    }
+
+    wanted := normalize(name)
+    folded := []string{}
+    for _, a := range available {
+        if a == name {
+            return a, nil
+        }
+        if normalize(a) == wanted {
+            folded = append(folded, a)
+        }
+    }
+    if len(folded) == 1 {
+        return folded[0], nil
+    }
+
+    maxDistance := len(wanted)/3 + 1
+    candidates := imageCandidates{}
+    for _, a := range available {
+        n := normalize(a)
+        distance := levenshtein(wanted, n)
+        if distance <= maxDistance || (wanted != "" && (strings.Contains(n, wanted) || strings.Contains(wanted, n))) {
+            candidates = append(candidates, imageCandidate{a, distance})
+        }
+    }
+    sort.Stable(candidates)
+
+    suggestions := []string{}
+    for _, c := range candidates {
+        if len(suggestions) == maxImageSuggestions {
+            break
+        }
+        suggestions = append(suggestions, c.name)
+    }
+    return "", suggestions
+}
+
+type imageCandidate struct {
+    name     string
+    distance int
+}
+
+type imageCandidates []imageCandidate
+
+func (c imageCandidates) Len() int           { return len(c) }
+func (c imageCandidates) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c imageCandidates) Less(i, j int) bool { return c[i].distance < c[j].distance }
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+    ra, rb := []rune(a), []rune(b)
+    prev := make([]int, len(rb)+1)
+    curr := make([]int, len(rb)+1)
+    for j := range prev {
+        prev[j] = j
+    }
+    for i := 1; i <= len(ra); i++ {
+        curr[0] = i
+        for j := 1; j <= len(rb); j++ {
+            cost := 1
+            if ra[i-1] == rb[j-1] {
+                cost = 0
+            }
+            curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+        }
+        prev, curr = curr, prev
+    }
+    return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+    if a < b {
+        return a
+    }
+    return b
+}
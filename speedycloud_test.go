@@ -1,29 +1,915 @@
 package speedycloud
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/hna/speedycloud"
+	"github.com/hna/speedycloud/computing/v2/jobs"
+	"github.com/hna/speedycloud/computing/v2/keypairs"
+	"github.com/hna/speedycloud/computing/v2/servers"
+	"github.com/hna/speedycloud/computing/v2/snapshots"
+	"github.com/hna/speedycloud/testhelper"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 func TestSetConfigFromFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "speedycloud")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
 	driver := NewDriver("default", "path")
 
 	checkFlags := &drivers.CheckDriverOptions{
 		FlagsValues: map[string]interface{}{
-			"openstack-auth-url":  "http://url",
-			"openstack-username":  "user",
-			"openstack-password":  "pwd",
-			"openstack-tenant-id": "ID",
-			"openstack-flavor-id": "ID",
-			"openstack-image-id":  "ID",
+			"speedycloud-credentials-file":  filepath.Join(dir, "credentials"),
+			"speedycloud-url":               "https://api.example.com/api/v1/products",
+			"speedycloud-api-key":           "key",
+			"speedycloud-api-secret":        "secret",
+			"speedycloud-availability-zone": "SPC-BJ-15-A",
+			"speedycloud-image-type":        "CentOS 7.2",
 		},
 		CreateFlags: driver.GetCreateFlags(),
 	}
 
-	err := driver.SetConfigFromFlags(checkFlags)
+	err = driver.SetConfigFromFlags(checkFlags)
 
 	assert.NoError(t, err)
 	assert.Empty(t, checkFlags.InvalidFlags)
+	assert.Equal(t, "CentOS 7.2", driver.(*Driver).ImageType)
+}
+
+func TestMatchImageName(t *testing.T) {
+	available := []string{"Ubuntu 14.04", "Ubuntu 16.04", "CentOS 7.2"}
+
+	name, suggestions := matchImageName("Ubuntu 14.04", available)
+	assert.Equal(t, "Ubuntu 14.04", name)
+	assert.Empty(t, suggestions)
+
+	name, _ = matchImageName("ubuntu14.04", available)
+	assert.Equal(t, "Ubuntu 14.04", name)
+
+	name, suggestions = matchImageName("Ubuntu 14.4", available)
+	assert.Empty(t, name)
+	assert.Equal(t, []string{"Ubuntu 14.04", "Ubuntu 16.04"}, suggestions)
+
+	name, suggestions = matchImageName("Windows 2012", available)
+	assert.Empty(t, name)
+	assert.Empty(t, suggestions)
+}
+
+func TestSecurityGroupNames(t *testing.T) {
+	driver := NewDerivedDriver("default", "path")
+	driver.SecurityGroups = splitList(" web, docker-machine,,db ")
+
+	assert.Equal(t, []string{"web", "docker-machine", "db"}, driver.SecurityGroups)
+	assert.Equal(t, []string{"docker-machine", "web", "db"}, driver.securityGroupNames())
+}
+
+func TestParseVolumeSpecs(t *testing.T) {
+	specs, err := parseVolumeSpecs([]string{"50", "SSD:100"}, "Normal")
+	assert.NoError(t, err)
+	assert.Equal(t, []volumeSpec{{"Normal", 50}, {"SSD", 100}}, specs)
+
+	_, err = parseVolumeSpecs([]string{"SSD:big"}, "Normal")
+	assert.Error(t, err)
+
+	_, err = parseVolumeSpecs([]string{":10"}, "Normal")
+	assert.Error(t, err)
+}
+
+func TestSelectIPAddress(t *testing.T) {
+	driver := NewDerivedDriver("default", "path")
+	addresses := []IPAddress{
+		{Address: "100.1.2.3", Version: 4},
+		{Address: "172.200.0.1", Version: 4},
+		{Address: "10.0.0.5", Version: 4},
+		{Address: "192.168.1.5", Version: 4},
+		{Address: "2001:db8::1", Version: 6},
+	}
+
+	driver.IpType = "inner"
+	assert.Equal(t, "10.0.0.5", driver.selectIPAddress(addresses).Address)
+
+	driver.IpCidr = "192.168.0.0/16"
+	assert.Equal(t, "192.168.1.5", driver.selectIPAddress(addresses).Address)
+
+	driver.IpType = "outer"
+	driver.IpCidr = ""
+	assert.Equal(t, "100.1.2.3", driver.selectIPAddress(addresses).Address)
+
+	driver.IpCidr = "2001:db8::/32"
+	assert.Equal(t, "2001:db8::1", driver.selectIPAddress(addresses).Address)
+
+	driver.IpCidr = "8.8.8.0/24"
+	assert.Nil(t, driver.selectIPAddress(addresses))
+}
+
+func TestResizeRejectsDiskShrink(t *testing.T) {
+	driver := NewDerivedDriver("default", "path")
+	driver.DiskCapacity = 50
+
+	assert.Error(t, driver.Resize(0, 0, 0, 20))
+	assert.Equal(t, 50, driver.DiskCapacity)
+}
+
+func TestMatchSnapshot(t *testing.T) {
+	ref, ok := snapshotReference("snapshot: golden-docker")
+	assert.True(t, ok)
+	assert.Equal(t, "golden-docker", ref)
+	_, ok = snapshotReference("Ubuntu 14.04")
+	assert.False(t, ok)
+
+	available := []snapshots.Snapshot{
+		{ID: "11", Name: "golden-docker"},
+		{ID: "12", Name: "base"},
+		{ID: "13", Name: "base"},
+	}
+
+	snapshot, err := matchSnapshot("golden-docker", available)
+	assert.NoError(t, err)
+	assert.Equal(t, "11", snapshot.ID)
+
+	snapshot, err = matchSnapshot("13", available)
+	assert.NoError(t, err)
+	assert.Equal(t, "13", snapshot.ID)
+
+	_, err = matchSnapshot("base", available)
+	assert.Error(t, err)
+
+	snapshot, err = matchSnapshot("missing", available)
+	assert.NoError(t, err)
+	assert.Nil(t, snapshot)
+}
+
+// deletedInstanceClient answers as the API does once the instance is gone.
+type deletedInstanceClient struct {
+	Client
+}
+
+func (c *deletedInstanceClient) InitProviderClient(d *Driver) error { return nil }
+func (c *deletedInstanceClient) InitComputeClient(d *Driver) error  { return nil }
+
+func (c *deletedInstanceClient) GetInstanceState(d *Driver) (string, bool, error) {
+	return "", false, &speedycloud.APIError{StatusCode: 404, Code: "InstanceNotFound"}
+}
+
+func TestGetStateOfDeletedInstance(t *testing.T) {
+	driver := NewDerivedDriver("default", "path")
+	driver.SetClient(&deletedInstanceClient{})
+
+	s, err := driver.GetState()
+	assert.Equal(t, state.None, s)
+	assert.Equal(t, ErrInstanceNotFound, err)
+	assert.NoError(t, driver.destroyInstance())
+}
+
+// unavailableClient answers as the API does while it fails, and records the
+// timeouts of the status waits.
+type unavailableClient struct {
+	Client
+	timeouts []int
+}
+
+func (c *unavailableClient) InitProviderClient(d *Driver) error { return nil }
+func (c *unavailableClient) InitComputeClient(d *Driver) error  { return nil }
+
+func (c *unavailableClient) GetInstanceState(d *Driver) (string, bool, error) {
+	return "", false, &speedycloud.APIError{StatusCode: 500, Code: "InternalError"}
+}
+
+func (c *unavailableClient) StartInstance(d *Driver) (string, error)    { return "", nil }
+func (c *unavailableClient) PowerOffInstance(d *Driver) (string, error) { return "", nil }
+
+func (c *unavailableClient) WaitForInstanceStatus(d *Driver, status string, timeout int) error {
+	c.timeouts = append(c.timeouts, timeout)
+	return nil
+}
+
+func TestUnavailableInstance(t *testing.T) {
+	driver := NewDerivedDriver("default", "path")
+	driver.ActiveTimeout = 200
+	driver.JobTimeout = 600
+	client := &unavailableClient{}
+	driver.SetClient(client)
+
+	// An operation without a job waits for its status as long as for a job.
+	assert.NoError(t, driver.Start())
+	assert.NoError(t, driver.Kill())
+	assert.Equal(t, []int{600, 600}, client.timeouts)
+
+	// Only a missing instance counts as deleted.
+	assert.Error(t, driver.destroyInstance())
+	assert.Error(t, driver.waitForInstanceDeleted())
+}
+
+// busyInstanceClient answers as the API does while a job, such as attaching
+// a volume, runs on an instance.
+type busyInstanceClient struct {
+	Client
+	status string
+}
+
+func (c *busyInstanceClient) InitProviderClient(d *Driver) error { return nil }
+func (c *busyInstanceClient) InitComputeClient(d *Driver) error  { return nil }
+
+func (c *busyInstanceClient) GetInstanceState(d *Driver) (string, bool, error) {
+	return c.status, true, nil
+}
+
+func TestGetStateWithRunningJob(t *testing.T) {
+	driver := NewDerivedDriver("default", "path")
+
+	driver.SetClient(&busyInstanceClient{status: "Running"})
+	s, err := driver.GetState()
+	assert.NoError(t, err)
+	assert.Equal(t, state.Running, s)
+
+	driver.SetClient(&busyInstanceClient{status: "Stopped"})
+	s, err = driver.GetState()
+	assert.NoError(t, err)
+	assert.Equal(t, state.Stopped, s)
+}
+
+func TestInstanceState(t *testing.T) {
+	cases := []struct {
+		status   string
+		expected state.State
+	}{
+		{"Running", state.Running},
+		{"Stopped", state.Stopped},
+		{"Suspended", state.Saved},
+		{"Provisioning", state.Starting},
+		{"Restarting", state.Starting},
+		{"Resizing", state.Starting},
+		{"Migrating", state.Starting},
+		{"Stopping", state.Stopping},
+		{"Deleting", state.Stopping},
+		{"ERROR", state.Error},
+	}
+	for _, c := range cases {
+		s, err := instanceState(c.status)
+		assert.NoError(t, err, c.status)
+		assert.Equal(t, c.expected, s, c.status)
+	}
+
+	_, err := instanceState("Deleted")
+	assert.Equal(t, ErrInstanceNotFound, err)
+
+	s, err := instanceState("Hibernating")
+	assert.Error(t, err)
+	assert.Equal(t, state.Error, s)
+}
+
+func TestNewTransport(t *testing.T) {
+	driver := NewDerivedDriver("default", "path")
+	driver.Insecure = true
+	driver.Proxy = "http://proxy.example.com:3128"
+
+	transport, err := newTransport(driver)
+	assert.NoError(t, err)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify)
+
+	req, _ := http.NewRequest("POST", defaultURL, nil)
+	proxyURL, err := transport.Proxy(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "proxy.example.com:3128", proxyURL.Host)
+
+	driver.CaCert = "/nonexistent/ca.pem"
+	_, err = newTransport(driver)
+	assert.Error(t, err)
+}
+
+func TestLoadProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "speedycloud")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "credentials")
+	content := "[default]\napi_key = key\napi_secret = secret\n\n[staging]\napi_key = staging-key\napi_secret = staging-secret\navailability_zone = SPC-SH-01-A\n"
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(content), 0600))
+
+	profile, err := loadProfile(filename, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "key", profile.ApiKey)
+
+	profile, err = loadProfile(filename, "staging")
+	assert.NoError(t, err)
+	driver := NewDerivedDriver("default", "path")
+	driver.ApiKey = "flag-key"
+	driver.applyProfile(profile)
+	assert.Equal(t, "flag-key", driver.ApiKey)
+	assert.Equal(t, "staging-secret", driver.ApiSecret)
+	assert.Equal(t, "SPC-SH-01-A", driver.AvailabilityZone)
+	assert.Equal(t, defaultURL, driver.SpeedCloudUrl)
+
+	_, err = loadProfile(filename, "production")
+	assert.Error(t, err)
+
+	profile, err = loadProfile(filepath.Join(dir, "missing"), "")
+	assert.NoError(t, err)
+	assert.Empty(t, profile.ApiKey)
+}
+
+func TestCredentialHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "speedycloud")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	credentialsFile := filepath.Join(dir, "credentials")
+	content := "[default]\napi_key = profile-key\napi_secret = profile-secret\n"
+	assert.NoError(t, ioutil.WriteFile(credentialsFile, []byte(content), 0600))
+
+	marker := filepath.Join(dir, "called")
+	helper := filepath.Join(dir, "helper.sh")
+	script := "#!/bin/sh\ntouch " + marker + "\necho helper-key\necho helper-secret\n"
+	assert.NoError(t, ioutil.WriteFile(helper, []byte(script), 0700))
+
+	driver := NewDriver("default", "path")
+	checkFlags := &drivers.CheckDriverOptions{
+		FlagsValues: map[string]interface{}{
+			"speedycloud-credentials-file":  credentialsFile,
+			"speedycloud-credential-helper": helper,
+		},
+		CreateFlags: driver.GetCreateFlags(),
+	}
+
+	assert.NoError(t, driver.SetConfigFromFlags(checkFlags))
+	_, err = os.Stat(marker)
+	assert.NoError(t, err, "the credential helper was not called")
+	assert.Equal(t, credentialSourceHelper, driver.(*Driver).CredentialSource)
+	assert.Equal(t, "helper-key", driver.(*Driver).ApiKey)
+	assert.Equal(t, "helper-secret", driver.(*Driver).ApiSecret)
+}
+
+func TestCredentialsPersistence(t *testing.T) {
+	driver := NewDerivedDriver("default", "path")
+	driver.ApiKey = "key"
+	driver.ApiSecret = "secret"
+
+	driver.CredentialSource = credentialSourceProfile
+	data, err := json.Marshal(driver)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "secret\"")
+
+	driver.CredentialSource = credentialSourceConfig
+	data, err = json.Marshal(driver)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "\"ApiSecret\":\"secret\"")
+}
+
+func TestLegacyCredentials(t *testing.T) {
+	legacyConfig := []byte(`{"ApiKey":"key","ApiSecret":"secret","MachineName":"default","CredentialsFile":"/nonexistent"}`)
+
+	// roundTrip loads a machine created before the credential sources existed
+	// and saves it again.
+	roundTrip := func() (*Driver, string) {
+		legacy := NewDerivedDriver("default", "path")
+		assert.NoError(t, json.Unmarshal(legacyConfig, legacy))
+		data, err := json.Marshal(legacy)
+		assert.NoError(t, err)
+		return legacy, string(data)
+	}
+
+	legacy, data := roundTrip()
+	assert.Empty(t, legacy.CredentialSource)
+	assert.Contains(t, data, "\"ApiSecret\":\"secret\"")
+
+	os.Setenv(apiKeyEnvVar, "key")
+	os.Setenv(apiSecretEnvVar, "secret")
+	defer os.Unsetenv(apiKeyEnvVar)
+	defer os.Unsetenv(apiSecretEnvVar)
+
+	// The environment alone does not migrate the machine, its secret is kept.
+	legacy, data = roundTrip()
+	assert.Empty(t, legacy.CredentialSource)
+	assert.Contains(t, data, "\"ApiSecret\":\"secret\"")
+
+	os.Setenv(migrateCredentialsEnvVar, "1")
+	defer os.Unsetenv(migrateCredentialsEnvVar)
+	legacy, data = roundTrip()
+	assert.Equal(t, credentialSourceEnv, legacy.CredentialSource)
+	assert.Equal(t, "default", legacy.MachineName)
+	assert.NotContains(t, data, "\"ApiSecret\":\"secret\"")
+
+	legacy.ApiKey, legacy.ApiSecret = "", ""
+	assert.NoError(t, legacy.resolveCredentials())
+	assert.Equal(t, "secret", legacy.ApiSecret)
+
+	// Credentials that are not available elsewhere stay in the configuration.
+	os.Setenv(apiSecretEnvVar, "rotated")
+	legacy, data = roundTrip()
+	assert.Equal(t, credentialSourceConfig, legacy.CredentialSource)
+	assert.Contains(t, data, "\"ApiSecret\":\"secret\"")
+}
+
+func TestMixedCredentials(t *testing.T) {
+	driver := NewDerivedDriver("default", "path")
+
+	source, err := driver.credentialSource("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, credentialSourceProfile, source)
+
+	source, err = driver.credentialSource("key", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, credentialSourceConfig, source)
+
+	_, err = driver.credentialSource("key", "")
+	assert.EqualError(t, err, errorMixedCredentials)
+	_, err = driver.credentialSource("", "secret")
+	assert.EqualError(t, err, errorMixedCredentials)
+}
+
+func TestStaticApiToken(t *testing.T) {
+	driver := NewDerivedDriver("default", "path")
+	driver.CredentialSource = credentialSourceEnv
+
+	os.Setenv(apiTokenEnvVar, "token")
+	defer os.Unsetenv(apiTokenEnvVar)
+	assert.NoError(t, driver.resolveCredentials())
+	assert.Equal(t, "token", driver.ApiToken)
+	assert.Empty(t, driver.ApiSecret)
+
+	data, err := json.Marshal(driver)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "\"ApiToken\":\"\"")
+
+	// Token authentication creates its tokens with the api key and secret.
+	driver.TokenAuth = true
+	assert.Error(t, driver.resolveCredentials())
+}
+
+// newTestDriver returns a driver creating the machine name in storePath
+// against the fake API, with the settings of the flag defaults.
+func newTestDriver(t *testing.T, api *testhelper.FakeAPI, storePath, name string) *Driver {
+	assert.NoError(t, os.MkdirAll(filepath.Join(storePath, "machines", name), 0700))
+	driver := NewDerivedDriver(name, storePath)
+	driver.SpeedCloudUrl = api.URL
+	driver.ApiKey = "key"
+	driver.ApiSecret = "secret"
+	driver.AvailabilityZone = defaultAvailabilityZone
+	driver.ImageType = "ubuntu14.04"
+	driver.CpuNumber = defaultCpuNumber
+	driver.Memory = defaultMemory
+	driver.DiskType = defaultDiskType
+	driver.DiskCapacity = defaultDiskCapacity
+	driver.Isp = defaultISP
+	driver.Bandwidth = defaultBandwidth
+	driver.IpType = defaultIpType
+	return driver
+}
+
+// newFakeAPIDriver returns a driver creating the machine "default" against a
+// new fake API, in a temporary store. cleanup stops the API and removes the
+// store.
+func newFakeAPIDriver(t *testing.T) (driver *Driver, api *testhelper.FakeAPI, cleanup func()) {
+	api = testhelper.NewFakeAPI("key", "secret")
+	storePath, err := ioutil.TempDir("", "speedycloud")
+	if err != nil {
+		api.Close()
+		t.Fatal(err)
+	}
+	cleanup = func() {
+		api.Close()
+		os.RemoveAll(storePath)
+	}
+	return newTestDriver(t, api, storePath, "default"), api, cleanup
+}
+
+func TestDriverLifecycle(t *testing.T) {
+	driver, api, cleanup := newFakeAPIDriver(t)
+	defer cleanup()
+
+	assert.NoError(t, driver.PreCreateCheck())
+	assert.NoError(t, driver.Create())
+
+	server, ok := api.Server(driver.MachineId)
+	assert.True(t, ok)
+	assert.Equal(t, testhelper.StatusRunning, server.Status)
+	assert.Equal(t, "Ubuntu 14.04", server.Image)
+	assert.Equal(t, "default", server.Alias)
+	assert.Equal(t, []string{defaultSecurityGroup}, server.SecurityGroups)
+	assert.Equal(t, server.Ips[0], driver.IPAddress)
+
+	publicKey, err := ioutil.ReadFile(driver.publicSSHKeyPath())
+	assert.NoError(t, err)
+	keyPairs := api.KeyPairs()
+	assert.Len(t, keyPairs, 1)
+	assert.Equal(t, keyPairs[0].ID, server.SSHKey)
+	assert.Equal(t, strings.TrimSpace(string(publicKey))+" "+generatedKeyPairTag, keyPairs[0].PublicKey)
+	assert.True(t, driver.KeyPairGenerated)
+
+	api.FailNextJob("stop", "hypervisor unavailable")
+	err = driver.Stop()
+	assert.IsType(t, &jobs.FailedError{}, err)
+	assert.Contains(t, err.Error(), "hypervisor unavailable")
+	s, err := driver.GetState()
+	assert.NoError(t, err)
+	assert.Equal(t, state.Running, s)
+
+	assert.NoError(t, driver.Stop())
+	s, err = driver.GetState()
+	assert.NoError(t, err)
+	assert.Equal(t, state.Stopped, s)
+
+	assert.NoError(t, driver.Start())
+	s, err = driver.GetState()
+	assert.NoError(t, err)
+	assert.Equal(t, state.Running, s)
+
+	driver.RestartMethod = "hard"
+	assert.NoError(t, driver.Restart())
+	jobList := api.Jobs()
+	assert.Equal(t, "hard_restart", jobList[len(jobList)-1].Action)
+
+	api.HangNextJob("stop")
+	driver.StopTimeout = 1
+	assert.NoError(t, driver.Stop())
+	s, err = driver.GetState()
+	assert.NoError(t, err)
+	assert.Equal(t, state.Stopped, s)
+	jobList = api.Jobs()
+	assert.Equal(t, "power_off", jobList[len(jobList)-1].Action)
+	assert.Equal(t, testhelper.JobFailed, jobList[len(jobList)-2].Status)
+
+	assert.NoError(t, driver.Start())
+	assert.NoError(t, driver.Remove())
+	_, ok = api.Server(driver.MachineId)
+	assert.False(t, ok)
+	_, err = driver.GetState()
+	assert.Equal(t, ErrInstanceNotFound, err)
+	assert.Empty(t, api.KeyPairs())
+}
+
+func TestCreateRollback(t *testing.T) {
+	driver, api, cleanup := newFakeAPIDriver(t)
+	defer cleanup()
+
+	// The keypair, the security group and the instance exist when provisioning fails.
+	api.FailNextJob("provision", "no capacity left in SPC-BJ-15-A")
+	err := driver.Create()
+	assert.EqualError(t, err, "Server "+driver.MachineId+" is in Error state")
+	_, ok := api.Server(driver.MachineId)
+	assert.False(t, ok)
+	assert.Empty(t, api.KeyPairs())
+	assert.Empty(t, api.SecurityGroups())
+}
+
+func TestFloatingIP(t *testing.T) {
+	first, api, cleanup := newFakeAPIDriver(t)
+	defer cleanup()
+
+	// A new address is allocated from the pool, and stays allocated once the
+	// machine is removed so that the next one can take it over.
+	first.FloatingIpPool = "BGP"
+	assert.NoError(t, first.PreCreateCheck())
+	assert.NoError(t, first.Create())
+	ips := api.FloatingIPs()
+	assert.Len(t, ips, 1)
+	assert.Equal(t, first.MachineId, ips[0].ServerID)
+	assert.Equal(t, ips[0].ID, first.FloatingIpId)
+	assert.Equal(t, ips[0].IP, first.IPAddress)
+
+	second := newTestDriver(t, api, first.StorePath, "second")
+	second.FloatingIp = ips[0].IP
+	assert.EqualError(t, second.PreCreateCheck(), fmt.Sprintf(errorUnavailableFloatingIP, ips[0].IP))
+
+	assert.NoError(t, first.Remove())
+	ips = api.FloatingIPs()
+	assert.Len(t, ips, 1)
+	assert.Empty(t, ips[0].ServerID)
+
+	// --speedycloud-floatingip reuses the address.
+	assert.NoError(t, second.PreCreateCheck())
+	assert.NoError(t, second.Create())
+	ips = api.FloatingIPs()
+	assert.Len(t, ips, 1)
+	assert.Equal(t, second.MachineId, ips[0].ServerID)
+	assert.Equal(t, ips[0].IP, second.IPAddress)
+	assert.NoError(t, second.Remove())
+	assert.Empty(t, api.FloatingIPs()[0].ServerID)
+}
+
+func TestVolumes(t *testing.T) {
+	cases := []struct {
+		volumes       []string
+		deleteVolumes bool
+		diskTypes     []string
+		sizes         []int
+	}{
+		// Volumes are attached at creation, and only detached on removal.
+		{[]string{"10", "SSD:20"}, false, []string{defaultDiskType, "SSD"}, []int{10, 20}},
+		// --speedycloud-delete-volumes deletes them once detached.
+		{[]string{"10"}, true, []string{defaultDiskType}, []int{10}},
+	}
+	for _, c := range cases {
+		driver, api, cleanup := newFakeAPIDriver(t)
+		defer cleanup()
+		driver.Volumes = c.volumes
+		driver.DeleteVolumes = c.deleteVolumes
+
+		assert.NoError(t, driver.Create())
+		volumes := api.Volumes()
+		assert.Len(t, volumes, len(c.volumes))
+		for i, volume := range volumes {
+			assert.Equal(t, volume.ID, driver.VolumeIds[i])
+			assert.Equal(t, fmt.Sprintf("default-data-%d", i+1), volume.Name)
+			assert.Equal(t, c.diskTypes[i], volume.DiskType)
+			assert.Equal(t, c.sizes[i], volume.Size)
+			assert.Equal(t, driver.MachineId, volume.ServerID)
+		}
+
+		assert.NoError(t, driver.Remove())
+		if c.deleteVolumes {
+			assert.Empty(t, api.Volumes())
+			assert.Empty(t, driver.VolumeIds)
+			continue
+		}
+		volumes = api.Volumes()
+		assert.Len(t, volumes, len(c.volumes))
+		for _, volume := range volumes {
+			assert.Empty(t, volume.ServerID)
+		}
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	driver, api, cleanup := newFakeAPIDriver(t)
+	defer cleanup()
+	assert.NoError(t, driver.Create())
+
+	snapshotID, err := driver.CreateSnapshot("base")
+	assert.NoError(t, err)
+	snapshotList := api.Snapshots()
+	assert.Len(t, snapshotList, 1)
+	assert.Equal(t, snapshotID, snapshotList[0].ID)
+	assert.Equal(t, "base", snapshotList[0].Name)
+	assert.Equal(t, driver.MachineId, snapshotList[0].ServerID)
+
+	assert.EqualError(t, driver.RestoreSnapshot(snapshotID), fmt.Sprintf(errorSnapshotRequiresStop, state.Running))
+	assert.NoError(t, driver.Stop())
+	assert.NoError(t, driver.RestoreSnapshot(snapshotID))
+	assert.Equal(t, 1, api.Snapshots()[0].Restores)
+	_, err = driver.CreateSnapshot("")
+	assert.Error(t, err)
+}
+
+func TestResize(t *testing.T) {
+	cases := []struct {
+		stopped                      bool
+		cpu, memory, bandwidth, disk int
+		actions                      []string
+		status                       string
+	}{
+		// A running machine is stopped to change its cpu, memory or disk.
+		{false, 4, 4096, 0, 40, []string{"provision", "stop", "resize", "start"}, testhelper.StatusRunning},
+		// The bandwidth changes on the fly.
+		{false, 0, 0, 10, 0, []string{"provision", "resize"}, testhelper.StatusRunning},
+		// A stopped machine stays stopped.
+		{true, 0, 2048, 0, 0, []string{"provision", "stop", "resize"}, testhelper.StatusStopped},
+	}
+	for _, c := range cases {
+		driver, api, cleanup := newFakeAPIDriver(t)
+		defer cleanup()
+		assert.NoError(t, driver.Create())
+		if c.stopped {
+			assert.NoError(t, driver.Stop())
+		}
+		before, _ := api.Server(driver.MachineId)
+
+		assert.NoError(t, driver.Resize(c.cpu, c.memory, c.bandwidth, c.disk))
+		server, _ := api.Server(driver.MachineId)
+		actions := []string{}
+		for _, job := range api.Jobs() {
+			actions = append(actions, job.Action)
+		}
+		assert.Equal(t, c.actions, actions)
+		assert.Equal(t, c.status, server.Status)
+
+		// Zero values keep the current settings.
+		expect := func(requested, current int) int {
+			if requested > 0 {
+				return requested
+			}
+			return current
+		}
+		assert.Equal(t, expect(c.cpu, before.Cpu), server.Cpu)
+		assert.Equal(t, expect(c.memory, before.Memory), server.Memory)
+		assert.Equal(t, expect(c.bandwidth, before.Bandwidth), server.Bandwidth)
+		assert.Equal(t, expect(c.disk, before.Disk), server.Disk)
+		assert.Equal(t, server.Cpu, driver.CpuNumber)
+		assert.Equal(t, server.Memory, driver.Memory)
+		assert.Equal(t, server.Bandwidth, driver.Bandwidth)
+		assert.Equal(t, server.Disk, driver.DiskCapacity)
+	}
+
+	driver, _, cleanup := newFakeAPIDriver(t)
+	defer cleanup()
+	assert.NoError(t, driver.Create())
+	assert.NoError(t, driver.Resize(0, 0, 0, 40))
+	assert.EqualError(t, driver.Resize(0, 0, 0, 30), fmt.Sprintf(errorDiskShrink, 40, 30))
+}
+
+func TestPreCreateCheckKeyPair(t *testing.T) {
+	driver, api, cleanup := newFakeAPIDriver(t)
+	defer cleanup()
+	driver.KeyPairName = "missing"
+	driver.PrivateKeyFile = filepath.Join(driver.StorePath, "id_rsa")
+	assert.NoError(t, ioutil.WriteFile(driver.PrivateKeyFile, []byte("private key"), 0600))
+
+	assert.EqualError(t, driver.PreCreateCheck(), fmt.Sprintf(errorUnknownKeyPairName, "missing"))
+
+	api.FailNext("sshkey", http.StatusForbidden, "AccessDenied", "Listing keypairs is not allowed")
+	err := driver.PreCreateCheck()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unable to look up keypair named missing")
+	assert.Contains(t, err.Error(), "Listing keypairs is not allowed")
+}
+
+func TestRemoveKeyPair(t *testing.T) {
+	api := testhelper.NewFakeAPI("key", "secret")
+	defer api.Close()
+
+	driver := NewDerivedDriver("default", "path")
+	driver.SpeedCloudUrl = api.URL
+	driver.ApiKey = "key"
+	driver.ApiSecret = "secret"
+	assert.NoError(t, driver.initCompute())
+	compute := driver.client.(*GenericClient).Compute
+
+	createKeyPair := func(name, publicKey string) string {
+		kp, err := keypairs.Create(compute, keypairs.CreateOpts{DisplayName: name, PublicKey: publicKey}).Extract()
+		assert.NoError(t, err)
+		return kp.ID
+	}
+	createKeyPair("user", "ssh-rsa AAAA user@laptop")
+	shared := createKeyPair("shared", "ssh-rsa AAAA "+generatedKeyPairTag)
+	createKeyPair("generated", "ssh-rsa AAAA "+generatedKeyPairTag)
+	_, err := servers.Create(compute, servers.CreateOpts{
+		AvailabilityZone: defaultAvailabilityZone,
+		ImageName:        defaultImage,
+		CpuNumber:        defaultCpuNumber,
+		Memory:           defaultMemory,
+		SshKey:           shared,
+	}).Extract()
+	assert.NoError(t, err)
+
+	driver.KeyPairName = "user"
+	assert.NoError(t, driver.removeKeyPair())
+	driver.KeyPairGenerated = true
+	assert.NoError(t, driver.removeKeyPair())
+	driver.KeyPairName = "shared"
+	assert.NoError(t, driver.removeKeyPair())
+	driver.KeyPairName = "generated"
+	assert.NoError(t, driver.removeKeyPair())
+
+	names := []string{}
+	for _, kp := range api.KeyPairs() {
+		names = append(names, kp.DisplayName)
+	}
+	assert.Equal(t, []string{"user", "shared"}, names)
+}
+
+// exerciseCompute creates a keypair and a server through transport, the way
+// the driver does, and reads them back.
+func exerciseCompute(t *testing.T, transport http.RoundTripper, endpoint, key, secret string) (*keypairs.KeyPair, *servers.Server) {
+	provider := &speedycloud.ProviderClient{ApiKey: key, ApiSecret: secret}
+	provider.HTTPClient.Transport = transport
+	compute, err := speedycloud.NewComputeV2(provider, endpoint)
+	assert.NoError(t, err)
+
+	assert.NoError(t, keypairs.Create(compute, keypairs.CreateOpts{DisplayName: "docker", PublicKey: "ssh-rsa AAAA docker"}).Err)
+	keyPair, err := keypairs.GetAll(compute).ExtractByDisplayName("docker")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	created, err := servers.Create(compute, servers.CreateOpts{
+		AvailabilityZone: defaultAvailabilityZone,
+		ImageName:        defaultImage,
+		CpuNumber:        defaultCpuNumber,
+		Memory:           defaultMemory,
+		SshKey:           keyPair.ID,
+		BootScript:       "#!/bin/sh\necho s3cr3t-join-token > /etc/swarm-token\n",
+	}).Extract()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	server, err := servers.Get(compute, created.ID).Extract()
+	assert.NoError(t, err)
+	return keyPair, server
+}
+
+func TestCassette(t *testing.T) {
+	api := testhelper.NewFakeAPI("key", "secret")
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "speedycloud")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cassette.json")
+
+	recorder, err := speedycloud.OpenCassette(path, speedycloud.CassetteRecord)
+	assert.NoError(t, err)
+	recorder.Secrets = []string{"AAAA"}
+	recordedKeyPair, recordedServer := exerciseCompute(t, recorder, api.URL, "key", "secret")
+	assert.Equal(t, "ssh-rsa AAAA docker", recordedKeyPair.PublicKey)
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "AAAA")
+	assert.NotContains(t, string(data), "s3cr3t-join-token")
+	assert.NotContains(t, string(data), "Authorization")
+
+	// Replaying needs neither the API nor the credentials.
+	api.Close()
+	player, err := speedycloud.OpenCassette(path, speedycloud.CassetteReplay)
+	assert.NoError(t, err)
+	player.Secrets = recorder.Secrets
+	replayedKeyPair, replayedServer := exerciseCompute(t, player, api.URL, "", "")
+	assert.Equal(t, recordedKeyPair.ID, replayedKeyPair.ID)
+	assert.Equal(t, "ssh-rsa <REDACTED> docker", replayedKeyPair.PublicKey)
+	assert.Equal(t, "<REDACTED>", replayedServer.BootScript)
+	replayedServer.BootScript = recordedServer.BootScript
+	assert.Equal(t, recordedServer, replayedServer)
+	assert.Equal(t, "Running", replayedServer.Status)
+	assert.Equal(t, "2", replayedServer.CpuNumber)
+}
+
+// TestCassetteFixture decodes the payloads recorded in testdata, see
+// TestRecordFixture to record them again.
+func TestCassetteFixture(t *testing.T) {
+	player, err := speedycloud.OpenCassette(filepath.Join("testdata", "compute.json"), speedycloud.CassetteReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPair, server := exerciseCompute(t, player, defaultURL, "", "")
+
+	assert.NotEmpty(t, keyPair.ID)
+	assert.Equal(t, "docker", keyPair.DisplayName)
+	assert.NotEmpty(t, keyPair.Fingerprint)
+	assert.NotEmpty(t, server.ID)
+	assert.Equal(t, defaultAvailabilityZone, server.Az.Name)
+	assert.Equal(t, "2", server.CpuNumber)
+	assert.Equal(t, "<REDACTED>", server.BootScript)
+	assert.NotEmpty(t, server.Status)
+}
+
+func TestPoller(t *testing.T) {
+	poller := &speedycloud.Poller{
+		Timeout:    50 * time.Millisecond,
+		Interval:   time.Millisecond,
+		Multiplier: 2,
+	}
+	attempts := 0
+	poller.Progress = func(p speedycloud.PollProgress) {
+		attempts = p.Attempt
+	}
+
+	err := poller.Poll(context.Background(), func() (string, bool, error) {
+		return "Provisioning", false, nil
+	})
+	assert.IsType(t, &speedycloud.TimeoutError{}, err)
+	assert.Contains(t, err.Error(), "Provisioning")
+	assert.True(t, attempts > 1)
+
+	calls := 0
+	err = poller.Poll(context.Background(), func() (string, bool, error) {
+		calls++
+		return "Running", calls == 3, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	// Only a Poller polls without a time limit when it has no timeout.
+	calls = 0
+	err = (&speedycloud.Poller{Interval: time.Millisecond}).Poll(context.Background(), func() (string, bool, error) {
+		calls++
+		return "Running", calls == 5, nil
+	})
+	assert.NoError(t, err)
+
+	err = speedycloud.WaitFor(-1, func() (bool, error) {
+		return false, errors.New("Instance is in ERROR state")
+	})
+	assert.EqualError(t, err, "Instance is in ERROR state")
+
+	// WaitFor checks at once, and a timeout of zero expires after that check.
+	calls = 0
+	err = speedycloud.WaitFor(0, func() (bool, error) {
+		calls++
+		return false, nil
+	})
+	assert.IsType(t, &speedycloud.TimeoutError{}, err)
+	assert.Equal(t, 1, calls)
 }